@@ -1,6 +1,7 @@
 package appimage
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -9,24 +10,44 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/lawl/ayy/appstream"
 	"github.com/lawl/ayy/desktop"
 	"github.com/lawl/ayy/elf"
+	"github.com/lawl/ayy/iso9660"
 	"github.com/lawl/ayy/squashfs"
 )
 
+// FS is the filesystem inside an AppImage, squashfs for type 2 and
+// ISO 9660 for type 1 AppImages. The FileInfo.Sys() of its files
+// implements squashfs.SquashInfo
+type FS interface {
+	fs.ReadDirFS
+}
+
 type AppImage struct {
 	ImageFormatType uint
-	FS              *squashfs.SquashFS
+	FS              FS
 	elf             *elf.File
 	file            *os.File
+	payloadOffset   int64
+	elfSize         int64
 }
 
 func Open(file string) (*AppImage, error) {
+	return open(file, os.O_RDONLY)
+}
+
+// OpenForWriting opens the AppImage so its ELF sections can be changed with WriteELFSection()
+func OpenForWriting(file string) (*AppImage, error) {
+	return open(file, os.O_RDWR)
+}
 
-	f, err := os.Open(file)
+func open(file string, flag int) (*AppImage, error) {
+
+	f, err := os.OpenFile(file, flag, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -48,10 +69,6 @@ func Open(file string) (*AppImage, error) {
 	}
 	ai.ImageFormatType = uint(el.Pad[1])
 
-	if ai.ImageFormatType == 1 {
-		return nil, errors.New("AppImage v1 is not supported currently. Use AppImage v2")
-	}
-
 	elfSz := el.Shoff + (int64(el.Shentsize) * int64(el.Shnum))
 
 	stat, err := f.Stat()
@@ -59,7 +76,22 @@ func Open(file string) (*AppImage, error) {
 		return nil, err
 	}
 
-	squashReader := io.NewSectionReader(f, elfSz, stat.Size()-elfSz)
+	// type 1 is an ISO 9660 image, with the runtime in its system area
+	if ai.ImageFormatType == 1 {
+		isofs, err := iso9660.New(f, stat.Size())
+		if err != nil {
+			return nil, fmt.Errorf("type 1 AppImage: %w", err)
+		}
+		ai.FS = isofs
+		ai.elfSize = elfSz
+		return &ai, nil
+	}
+
+	offset, err := findPayload(f, elfSz, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	squashReader := io.NewSectionReader(f, offset, stat.Size()-offset)
 
 	sqfs, err := squashfs.New(squashReader)
 	if err != nil {
@@ -67,9 +99,65 @@ func Open(file string) (*AppImage, error) {
 	}
 
 	ai.FS = sqfs
+	ai.elfSize = elfSz
+	ai.payloadOffset = offset
 
 	return &ai, nil
 }
+
+// the filesystem usually starts right where the ELF ends. but some runtimes have
+// things appended, are padded, or have the section headers somewhere else, so if
+// there is no filesystem where we expect it, look for the squashfs magic instead
+func findPayload(f *os.File, elfSz, size int64) (int64, error) {
+	// where it's expected, a truncated or damaged filesystem is still the filesystem, New() and fsck report what's wrong.
+	// only the scan needs the strict probe, the runtime likely contains the magic too
+	if elfSz > 0 && elfSz < size && squashfs.ProbeHeader(f, elfSz) == nil {
+		return elfSz, nil
+	}
+
+	const chunkSz = 1 << 20
+	magic := []byte("hsqs")
+	buf := make([]byte, chunkSz+len(magic)-1)
+	for pos := int64(0); pos < size; pos += chunkSz {
+		n, err := f.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		chunk := buf[:n]
+		for i := 0; i < len(chunk); {
+			idx := bytes.Index(chunk[i:], magic)
+			if idx < 0 {
+				break
+			}
+			candidate := pos + int64(i+idx)
+			// the runtime itself likely contains the magic too, the superblock check sorts that out
+			if squashfs.ProbeSuperblock(f, candidate, size-candidate) == nil {
+				return candidate, nil
+			}
+			i += idx + 1
+		}
+	}
+	return 0, fmt.Errorf("no squashfs filesystem found, expected one at offset %d", elfSz)
+}
+
+// SquashFS returns the filesystem as squashfs, or nil for type 1 AppImages
+func (ai *AppImage) SquashFS() *squashfs.SquashFS {
+	sqfs, _ := ai.FS.(*squashfs.SquashFS)
+	return sqfs
+}
+
+// PayloadOffset returns where in the file the filesystem starts.
+// For type 1 AppImages that's 0, the runtime is inside the ISO 9660 image.
+func (ai *AppImage) PayloadOffset() int64 {
+	return ai.payloadOffset
+}
+
+// ELFSize returns where the runtime ELF ends according to its headers. Usually that's
+// where the filesystem starts, if it's not, PayloadOffset() is where it was found instead.
+func (ai *AppImage) ELFSize() int64 {
+	return ai.elfSize
+}
+
 func (ai *AppImage) Close() {
 	ai.file.Close()
 }
@@ -86,6 +174,46 @@ func (ai *AppImage) ELFSectionAsString(section string) (string, error) {
 	return ret, nil
 }
 
+// type 1 AppImages have the update information in the application
+// use field of the ISO 9660 primary volume descriptor
+const (
+	type1UpdInfoOffset = 33651
+	type1UpdInfoSize   = 512
+)
+
+// UpdateInfo returns the embedded update information, or an empty string if there is none
+func (ai *AppImage) UpdateInfo() (string, error) {
+	if ai.ImageFormatType == 1 {
+		buf := make([]byte, type1UpdInfoSize)
+		if _, err := ai.file.ReadAt(buf, type1UpdInfoOffset); err != nil {
+			return "", err
+		}
+		return strings.Trim(string(buf), "\x00 "), nil
+	}
+	return ai.ELFSectionAsString(".upd_info")
+}
+
+// SetUpdateInfo replaces the embedded update information.
+// The AppImage must have been opened with OpenForWriting()
+func (ai *AppImage) SetUpdateInfo(info string) error {
+	if ai.ImageFormatType == 1 {
+		if len(info) > type1UpdInfoSize {
+			return fmt.Errorf("%d bytes don't fit into the update information of a type 1 AppImage, it only has room for %d", len(info), type1UpdInfoSize)
+		}
+		buf := make([]byte, type1UpdInfoSize)
+		copy(buf, info)
+		_, err := ai.file.WriteAt(buf, type1UpdInfoOffset)
+		return err
+	}
+	return ai.WriteELFSection(".upd_info", []byte(info))
+}
+
+// WriteELFSection replaces the contents of an ELF section, e.g. .upd_info.
+// The AppImage must have been opened with OpenForWriting()
+func (ai *AppImage) WriteELFSection(section string, data []byte) error {
+	return ai.elf.WriteSection(section, data)
+}
+
 func (ai *AppImage) DesktopFile() (*desktop.File, error) {
 	matches, err := fs.Glob(ai.FS, "*.desktop")
 	if err != nil {
@@ -161,7 +289,7 @@ type AppImageID string
 // However, the docs note that optionally an AppStream can be placed at a known location.
 // an AppStream does specify such an ID. If available, use that.
 // If not, we try to make a synthetic ID. If the application has update information
-// (.upd_info ELF section) we build a synthetic ID from that, as the AppImage spec say
+// (.upd_info ELF section, or in the ISO 9660 header for type 1) we build a synthetic ID from that, as the AppImage spec say
 //
 //     URL to the .zsync file (URL MUST NOT change from version to version)
 //
@@ -179,7 +307,7 @@ func (ai *AppImage) ID() AppImageID {
 		return AppImageID(asid)
 	}
 	var sanitizer = regexp.MustCompile(`[^A-Za-z\-]`)
-	updInfo, err := ai.ELFSectionAsString(".upd_info")
+	updInfo, err := ai.UpdateInfo()
 	if err == nil {
 		spl := strings.Split(updInfo, "|")
 		if len(spl) == 0 {
@@ -227,3 +355,67 @@ desktop:
 	filename = sanitizer.ReplaceAllString(filename, "")
 	return AppImageID(filename)
 }
+
+// ErrWrongArch is returned by CheckArch() if the AppImage can't run on this machine
+var ErrWrongArch = errors.New("AppImage was built for a different architecture")
+
+// Go's GOARCH => what elf.File.Arch() calls it
+var goArchNames = map[string]string{
+	"386":     "i386",
+	"amd64":   "x86_64",
+	"arm":     "armhf",
+	"arm64":   "aarch64",
+	"mips":    "mips",
+	"ppc64":   "ppc64",
+	"ppc64le": "ppc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+	"loong64": "loongarch64",
+}
+
+// HostArch returns the architecture of this machine, named like AppImage.Arch()
+func HostArch() string {
+	if name, ok := goArchNames[runtime.GOARCH]; ok {
+		return name
+	}
+	return runtime.GOARCH
+}
+
+// Arch returns the architecture the AppImage's runtime was built for, e.g. "x86_64".
+// The runtime is built for the same architecture as the app inside.
+func (ai *AppImage) Arch() string {
+	return ai.elf.Arch()
+}
+
+// Bits returns 32 or 64, depending on the runtime's ELF class
+func (ai *AppImage) Bits() int {
+	return ai.elf.Bits()
+}
+
+// architectures a machine can run besides its own, given the libraries are installed
+var compatArchs = map[string][]string{
+	"x86_64": {"i386"},
+}
+
+// ForeignArch returns whether the AppImage is built for another architecture than this
+// machine's, one the machine can run though, e.g. i386 on x86_64
+func (ai *AppImage) ForeignArch() bool {
+	if ai.Arch() == HostArch() {
+		return false
+	}
+	for _, arch := range compatArchs[HostArch()] {
+		if ai.Arch() == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckArch returns an error wrapping ErrWrongArch if the AppImage can't
+// run on the architecture of this machine
+func (ai *AppImage) CheckArch() error {
+	if ai.Arch() != HostArch() && !ai.ForeignArch() {
+		return fmt.Errorf("%w: AppImage is %s, this machine is %s", ErrWrongArch, ai.Arch(), HostArch())
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package appimage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lawl/ayy/desktop"
+	"github.com/lawl/ayy/elf"
+	"github.com/lawl/ayy/squashfs"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+type BuildOptions struct {
+	// the AppImage runtime ELF to put in front of the filesystem.
+	// it must have the .upd_info, .sha256_sig and .sig_key sections
+	// if update info or a signature should be embedded
+	Runtime string
+	// written to .upd_info, e.g. "gh-releases-zsync|user|repo|latest|Foo-*x86_64.AppImage.zsync"
+	UpdateInfo string
+	// sign the image with this key if set. the private key must already be decrypted, see DecryptSigningKey()
+	SignKey *openpgp.Entity
+	// squashfs options for the payload. unless changed, everything is owned by root
+	FS squashfs.WriterOptions
+}
+
+// ValidateAppDir checks that dir contains everything an AppImage needs.
+// Problems that make the AppImage unusable are returned as error, anything
+// else that's just not quite right as warnings.
+func ValidateAppDir(dir string) (warnings []string, err error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+
+	apprun, err := os.Stat(filepath.Join(dir, "AppRun"))
+	if err != nil {
+		return nil, fmt.Errorf("AppDir has no AppRun: %w", err)
+	}
+	if apprun.IsDir() || apprun.Mode()&0111 == 0 {
+		return nil, errors.New("AppRun is not an executable file")
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.desktop"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, errors.New("AppDir has no .desktop file in its top level directory")
+	}
+	if len(matches) > 1 {
+		warnings = append(warnings, fmt.Sprintf("AppDir has %d .desktop files, only '%s' will be used", len(matches), filepath.Base(matches[0])))
+	}
+	buf, err := os.ReadFile(matches[0])
+	if err != nil {
+		return nil, err
+	}
+	df, err := desktop.ParseEntry(string(buf))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse '%s': %w", filepath.Base(matches[0]), err)
+	}
+	entry, found := df.Group("Desktop Entry")
+	if !found {
+		return nil, fmt.Errorf("'%s' has no [Desktop Entry] group", filepath.Base(matches[0]))
+	}
+	for _, key := range []string{"Name", "Exec", "Icon"} {
+		if entry.KV[key] == "" {
+			return nil, fmt.Errorf("'%s' has no %s= entry", filepath.Base(matches[0]), key)
+		}
+	}
+	if entry.KV["Type"] != "Application" {
+		warnings = append(warnings, fmt.Sprintf("'%s' should have Type=Application", filepath.Base(matches[0])))
+	}
+
+	// .DirIcon is usually a symlink to the icon, make sure it's not dangling
+	if _, err := os.Stat(filepath.Join(dir, ".DirIcon")); err != nil {
+		warnings = append(warnings, fmt.Sprintf("AppDir has no usable .DirIcon, the AppImage will have no icon in file managers: %s", err))
+	}
+
+	return warnings, nil
+}
+
+// Build creates the AppImage outPath from the AppDir dir, by writing the runtime
+// followed by dir as squashfs. The AppDir isn't validated, call ValidateAppDir() first.
+func Build(outPath, dir string, opts BuildOptions) error {
+	runtime, err := os.ReadFile(opts.Runtime)
+	if err != nil {
+		return fmt.Errorf("reading runtime: %w", err)
+	}
+	if len(runtime) < 16 || !bytes.Equal(runtime[:4], []byte("\x7FELF")) {
+		return fmt.Errorf("runtime '%s' is not an ELF file", opts.Runtime)
+	}
+	// the runtime should already carry the AppImage magic, but make sure
+	copy(runtime[8:11], "AI\x02")
+
+	// build next to the target and only replace it once everything worked
+	tmpPath := outPath + ".ayybuild"
+	out, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	ok := false
+	defer func() {
+		out.Close()
+		if !ok {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := out.Write(runtime); err != nil {
+		return err
+	}
+	if _, err := squashfs.Write(out, squashfs.DirFS(dir), opts.FS); err != nil {
+		return fmt.Errorf("writing squashfs: %w", err)
+	}
+
+	if opts.UpdateInfo != "" {
+		el, err := elf.Open(out)
+		if err != nil {
+			return err
+		}
+		if err := el.WriteSection(".upd_info", []byte(opts.UpdateInfo)); err != nil {
+			return err
+		}
+	}
+
+	if err := writeDigest(out); err != nil {
+		return fmt.Errorf("writing digest: %w", err)
+	}
+
+	if opts.SignKey != nil {
+		if err := sign(out, opts.SignKey); err != nil {
+			return fmt.Errorf("signing: %w", err)
+		}
+	}
+
+	if err := out.Chmod(0755); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		return err
+	}
+	ok = true
+	return nil
+}
+
+// sign signs the AppImage the way appimagetool does, an armored detached
+// signature of the hex encoded SHA256WithoutSignature goes to .sha256_sig
+// and the armored public key to .sig_key
+func sign(f *os.File, key *openpgp.Entity) error {
+	if key.PrivateKey == nil {
+		return errors.New("key has no private key")
+	}
+	if key.PrivateKey.Encrypted {
+		return errors.New("private key is encrypted")
+	}
+
+	el, err := elf.Open(f)
+	if err != nil {
+		return err
+	}
+	ai := AppImage{file: f, elf: el}
+	sum, err := ai.SHA256WithoutSignature()
+	if err != nil {
+		return err
+	}
+
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, key, strings.NewReader(fmt.Sprintf("%x", sum)), nil); err != nil {
+		return err
+	}
+
+	var pub bytes.Buffer
+	w, err := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err := key.Serialize(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := el.WriteSection(".sha256_sig", sig.Bytes()); err != nil {
+		return err
+	}
+	return el.WriteSection(".sig_key", pub.Bytes())
+}
+
+// Sign signs the AppImage with key, replacing any existing signature.
+// The AppImage must have been opened with OpenForWriting()
+func (ai *AppImage) Sign(key *openpgp.Entity) error {
+	if ai.ImageFormatType == 1 {
+		return errors.New("type 1 AppImages can't be signed")
+	}
+	return sign(ai.file, key)
+}
+
+// DecryptSigningKey decrypts a passphrase protected private key, and its subkeys
+func DecryptSigningKey(key *openpgp.Entity, passphrase []byte) error {
+	if key.PrivateKey != nil && key.PrivateKey.Encrypted {
+		if err := key.PrivateKey.Decrypt(passphrase); err != nil {
+			return fmt.Errorf("wrong passphrase? %w", err)
+		}
+	}
+	for _, sub := range key.Subkeys {
+		if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+			if err := sub.PrivateKey.Decrypt(passphrase); err != nil {
+				return fmt.Errorf("wrong passphrase? %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadSigningKey reads an armored or binary private key from path
+func ReadSigningKey(path string) (*openpgp.Entity, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(buf))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key: %w", err)
+		}
+	}
+	for _, entity := range keyring {
+		if entity.PrivateKey != nil {
+			return entity, nil
+		}
+	}
+	return nil, fmt.Errorf("'%s' contains no private key", path)
+}
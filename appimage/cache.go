@@ -0,0 +1,138 @@
+package appimage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/lawl/ayy/xdg"
+)
+
+// hashing a few hundred MB for every ayy show takes a while, so digests are cached, keyed by the identity
+// of the file: device, inode, size, mtime and ctime. every write changes the ctime, and unlike the mtime,
+// it can't be set back, so a cached digest is never used for content it wasn't computed from.
+// only digests are cached, signatures are still checked against them every time, so what's trusted
+// always follows the current trust store and keyring.
+
+// files changed less than this long ago aren't cached, a second change could be within the timestamp granularity
+const digestCacheMinAge = 2 * time.Second
+
+var digestCacheDisabled bool
+
+// DisableDigestCache makes every digest computed from the file, for when the cache might have been tampered with
+func DisableDigestCache() {
+	digestCacheDisabled = true
+}
+
+type fileIdentity struct {
+	Dev   uint64 `json:"dev"`
+	Ino   uint64 `json:"ino"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+	Ctime int64  `json:"ctime"`
+}
+
+type digestCacheEntry struct {
+	File    fileIdentity      `json:"file"`
+	Digests map[string]string `json:"digests"`
+}
+
+func identify(f *os.File) (fileIdentity, bool) {
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return fileIdentity{}, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileIdentity{}, false
+	}
+	return fileIdentity{
+		Dev:   uint64(st.Dev),
+		Ino:   uint64(st.Ino),
+		Size:  st.Size,
+		Mtime: st.Mtim.Nano(),
+		Ctime: st.Ctim.Nano(),
+	}, true
+}
+
+func digestCachePath(id fileIdentity) string {
+	return filepath.Join(xdg.Get(xdg.CACHE_HOME), "ayy", "digests", fmt.Sprintf("%x-%x.json", id.Dev, id.Ino))
+}
+
+// loadDigestCache returns the cached digests for id, nil if there are none, or they're for another file
+func loadDigestCache(id fileIdentity) *digestCacheEntry {
+	f, err := os.Open(digestCachePath(id))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	// someone else's cache entry is not to be believed
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+		return nil
+	}
+	var e digestCacheEntry
+	if err := json.NewDecoder(f).Decode(&e); err != nil || e.File != id {
+		return nil
+	}
+	return &e
+}
+
+func saveDigestCache(e *digestCacheEntry) {
+	p := digestCachePath(e.File)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf)
+	if cerr := tmp.Close(); err != nil || cerr != nil {
+		return
+	}
+	os.Rename(tmp.Name(), p)
+}
+
+// cachedDigest returns the digest called kind from the cache, or computes and caches it.
+// Failing to cache isn't an error, it's just slower next time.
+func (ai *AppImage) cachedDigest(kind string, compute func() ([]byte, error)) ([]byte, error) {
+	before, ok := identify(ai.file)
+	if !ok || digestCacheDisabled {
+		return compute()
+	}
+	entry := loadDigestCache(before)
+	if entry != nil {
+		if d, err := hex.DecodeString(entry.Digests[kind]); err == nil && len(d) > 0 {
+			return d, nil
+		}
+	}
+
+	digest, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	// don't cache if the file changed while hashing
+	after, ok := identify(ai.file)
+	if !ok || after != before || time.Since(time.Unix(0, before.Ctime)) < digestCacheMinAge {
+		return digest, nil
+	}
+	if entry == nil {
+		entry = &digestCacheEntry{File: before, Digests: make(map[string]string)}
+	}
+	entry.Digests[kind] = hex.EncodeToString(digest)
+	saveDigestCache(entry)
+	return digest, nil
+}
@@ -0,0 +1,137 @@
+package appimage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lawl/ayy/elf"
+)
+
+// ErrCorrupt is returned if an AppImage's embedded MD5 digest doesn't match its contents
+var ErrCorrupt = errors.New("AppImage is corrupted")
+
+// the sections that are treated as zeroes when computing the digest. the spec only mentions
+// .digest_md5, but appimagetool embeds the digest before signing, so libappimage skips the
+// signature sections too, otherwise every signed AppImage would fail to verify
+var digestSkipSections = []string{".digest_md5", ".sha256_sig", ".sig_key", ".minisig", ".minisig_key"}
+
+// MD5WithoutDigest computes the MD5 sum of the AppImage, treating the .digest_md5,
+// .sha256_sig, .sig_key, .minisig and .minisig_key sections as if they were entirely 0x00 bytes
+func (ai *AppImage) MD5WithoutDigest() ([]byte, error) {
+	return ai.cachedDigest("md5-without-digest", func() ([]byte, error) {
+		return md5WithoutDigest(ai.file, ai.elf)
+	})
+}
+
+// SHA256 computes the SHA256 sum of the whole file
+func (ai *AppImage) SHA256() ([]byte, error) {
+	return ai.cachedDigest("sha256", func() ([]byte, error) {
+		if _, err := ai.file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, ai.file); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	})
+}
+
+func md5WithoutDigest(f *os.File, el *elf.File) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hashTarget := NewSkipReader(f)
+	for _, name := range digestSkipSections {
+		if sect := el.Section(name); sect != nil {
+			hashTarget.AddSkip(sect.Offset(), sect.Length())
+		}
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(h, hashTarget); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// embeddedDigest returns the MD5 digest in .digest_md5, nil if there is none.
+// appimagetool stores the raw 16 bytes, but also accept it hex encoded
+func (ai *AppImage) embeddedDigest() ([]byte, error) {
+	sect := ai.elf.Section(".digest_md5")
+	if sect == nil {
+		return nil, nil
+	}
+	data, err := sect.Data()
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.Trim(data, "\x00")) == 0 {
+		return nil, nil
+	}
+	if len(data) >= 32 && len(bytes.Trim(data[32:], "\x00")) == 0 {
+		if sum, err := hex.DecodeString(string(data[:32])); err == nil {
+			return sum, nil
+		}
+	}
+	if len(data) < md5.Size {
+		return nil, fmt.Errorf(".digest_md5 section is too small")
+	}
+	return data[:md5.Size], nil
+}
+
+// HasDigest returns whether the AppImage carries an MD5 digest in its .digest_md5 section
+func (ai *AppImage) HasDigest() bool {
+	sum, err := ai.embeddedDigest()
+	return err == nil && sum != nil
+}
+
+// VerifyDigest checks the embedded MD5 digest. If the AppImage has none, ok is false and err is nil,
+// check HasDigest() first. A digest that doesn't match returns an error wrapping ErrCorrupt.
+func (ai *AppImage) VerifyDigest() (ok bool, err error) {
+	want, err := ai.embeddedDigest()
+	if err != nil || want == nil {
+		return false, err
+	}
+	have, err := ai.MD5WithoutDigest()
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(want, have) {
+		return false, fmt.Errorf("%w: MD5 digest is %x, but the AppImage says it should be %x", ErrCorrupt, have, want)
+	}
+	return true, nil
+}
+
+// writeDigest computes the MD5 digest and embeds it, if the runtime has a .digest_md5 section.
+// Must happen before signing, as the signature covers the digest
+func writeDigest(f *os.File) error {
+	el, err := elf.Open(f)
+	if err != nil {
+		return err
+	}
+	if el.Section(".digest_md5") == nil {
+		return nil
+	}
+	sum, err := md5WithoutDigest(f, el)
+	if err != nil {
+		return err
+	}
+	return el.WriteSection(".digest_md5", sum)
+}
+
+// UpdateDigest recomputes the embedded MD5 digest after the AppImage was changed,
+// e.g. with SetUpdateInfo(). Does nothing if the AppImage has no digest.
+// The AppImage must have been opened with OpenForWriting()
+func (ai *AppImage) UpdateDigest() error {
+	if !ai.HasDigest() {
+		return nil
+	}
+	return writeDigest(ai.file)
+}
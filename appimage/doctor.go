@@ -0,0 +1,214 @@
+package appimage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/lawl/ayy/elf"
+)
+
+// RuntimeInfo describes the AppImage's runtime, the ELF in front of the filesystem
+type RuntimeInfo struct {
+	Arch string
+	Bits int
+	// dynamic linker, empty for a static runtime
+	Interpreter string
+	// shared libraries the runtime links against
+	Needed  []string
+	RunPath []string
+}
+
+// Static reports whether the runtime is statically linked. Static runtimes
+// bring their own libfuse and only need fusermount from the host
+func (r *RuntimeInfo) Static() bool {
+	return r.Interpreter == "" && len(r.Needed) == 0
+}
+
+// NeedsLibfuse2 reports whether the runtime links against libfuse.so.2,
+// which many distributions don't install by default anymore
+func (r *RuntimeInfo) NeedsLibfuse2() bool {
+	for _, lib := range r.Needed {
+		if strings.HasPrefix(lib, "libfuse.so.2") {
+			return true
+		}
+	}
+	return false
+}
+
+func (ai *AppImage) RuntimeInfo() (*RuntimeInfo, error) {
+	info := RuntimeInfo{Arch: ai.Arch(), Bits: ai.Bits()}
+	interp, err := ai.elf.Interpreter()
+	if err != nil {
+		return nil, fmt.Errorf("reading interpreter: %w", err)
+	}
+	info.Interpreter = interp
+	dyn, err := ai.elf.Dynamic()
+	if err != nil {
+		return nil, fmt.Errorf("reading dynamic section: %w", err)
+	}
+	if dyn != nil {
+		info.Needed = dyn.Needed
+		// DT_RPATH is deprecated, but still honored if there's no DT_RUNPATH
+		info.RunPath = dyn.RunPath
+		if len(info.RunPath) == 0 {
+			info.RunPath = dyn.RPath
+		}
+	}
+	return &info, nil
+}
+
+// Diagnosis is the result of AppImage.Diagnose()
+type Diagnosis struct {
+	Runtime RuntimeInfo
+	// things that keep the AppImage from starting
+	Problems []string
+	// things that might cause trouble
+	Warnings []string
+}
+
+const extractAndRunHint = "As a workaround, run the AppImage with APPIMAGE_EXTRACT_AND_RUN=1 set."
+
+// Diagnose checks whether this machine has what the AppImage's runtime needs to start,
+// i.e. the right architecture, the dynamic linker and libraries, and FUSE.
+// It only looks at the runtime, not at the application inside the AppImage.
+func (ai *AppImage) Diagnose() (*Diagnosis, error) {
+	rt, err := ai.RuntimeInfo()
+	if err != nil {
+		return nil, err
+	}
+	d := Diagnosis{Runtime: *rt}
+
+	if err := ai.CheckArch(); err != nil {
+		d.Problems = append(d.Problems, err.Error())
+		// nothing else we could check makes sense for a foreign architecture
+		return &d, nil
+	}
+	if ai.ForeignArch() {
+		d.Warnings = append(d.Warnings, fmt.Sprintf("AppImage is %s, this machine is %s. It runs, but needs the %s libraries of your distribution", ai.Arch(), HostArch(), ai.Arch()))
+	}
+
+	if rt.Interpreter != "" {
+		if _, err := os.Stat(rt.Interpreter); err != nil {
+			d.Problems = append(d.Problems, fmt.Sprintf("dynamic linker '%s' not found", rt.Interpreter))
+		}
+	}
+
+	origin := filepath.Dir(ai.file.Name())
+	if abs, err := filepath.Abs(origin); err == nil {
+		origin = abs
+	}
+	dirs := librarySearchPath(rt, origin)
+	for _, lib := range rt.Needed {
+		if findLibrary(lib, rt, dirs) != "" {
+			continue
+		}
+		if strings.HasPrefix(lib, "libfuse.so.2") {
+			d.Problems = append(d.Problems, "libfuse.so.2 not found. Install libfuse2 from your distribution (the package is usually called 'libfuse2' or 'fuse-libs'). "+extractAndRunHint)
+			continue
+		}
+		d.Problems = append(d.Problems, fmt.Sprintf("library '%s' not found", lib))
+	}
+
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		d.Problems = append(d.Problems, "/dev/fuse is not available, FUSE is not loaded or not usable here (e.g. in a container). "+extractAndRunHint)
+	}
+	fusermount := []string{"fusermount"}
+	if rt.Static() {
+		// static runtimes use libfuse3, which prefers fusermount3
+		fusermount = []string{"fusermount3", "fusermount"}
+	}
+	found := false
+	for _, bin := range fusermount {
+		if _, err := exec.LookPath(bin); err == nil {
+			found = true
+			break
+		}
+	}
+	if !found {
+		d.Warnings = append(d.Warnings, fmt.Sprintf("%s not found in PATH, mounting the AppImage will probably fail. Install fuse from your distribution. %s", strings.Join(fusermount, "/"), extractAndRunHint))
+	}
+
+	return &d, nil
+}
+
+// the directories the dynamic linker would search, roughly in its order
+func librarySearchPath(rt *RuntimeInfo, origin string) []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("LD_LIBRARY_PATH")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range rt.RunPath {
+		dir = strings.ReplaceAll(dir, "${ORIGIN}", origin)
+		dir = strings.ReplaceAll(dir, "$ORIGIN", origin)
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	dirs = append(dirs, readLdSoConf("/etc/ld.so.conf", 0)...)
+	if rt.Bits == 64 {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+	dirs = append(dirs, "/lib", "/usr/lib")
+	return dirs
+}
+
+// readLdSoConf returns the directories listed in an ld.so.conf, following includes
+func readLdSoConf(path string, depth int) (dirs []string) {
+	if depth > 10 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "include") {
+			pattern := strings.TrimSpace(strings.TrimPrefix(line, "include"))
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			matches, _ := filepath.Glob(pattern)
+			for _, m := range matches {
+				dirs = append(dirs, readLdSoConf(m, depth+1)...)
+			}
+			continue
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs
+}
+
+// findLibrary looks for lib in dirs, skipping libraries for a different architecture,
+// e.g. 32 bit ones in a multilib setup. Returns an empty string if not found.
+func findLibrary(lib string, rt *RuntimeInfo, dirs []string) string {
+	for _, dir := range dirs {
+		p := filepath.Join(dir, lib)
+		f, err := os.Open(p)
+		if err != nil {
+			continue
+		}
+		arch, bits, err := elf.ReadArch(f)
+		f.Close()
+		if err == nil && arch == rt.Arch && bits == rt.Bits {
+			return p
+		}
+	}
+	return ""
+}
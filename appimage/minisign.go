@@ -0,0 +1,395 @@
+package appimage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+)
+
+// minisign and signify signatures, as an alternative to OpenPGP.
+// formats: https://jedisct1.github.io/minisign/ and signify(1)
+//
+// embedded, the signature goes to .minisig and the public key to .minisig_key, and
+// cover the AppImage with all signature sections zeroed, like SHA256WithoutSignature().
+// a .minisig file next to the AppImage covers the whole file, as minisign -S creates it.
+
+var (
+	algLegacy    = [2]byte{'E', 'd'} // signs the message itself, also used by signify
+	algPrehashed = [2]byte{'E', 'D'} // signs the BLAKE2b-512 hash of the message
+)
+
+// ErrMinisignKeyMismatch is returned when a signature was made by a different key than the one to verify with
+var ErrMinisignKeyMismatch = errors.New("minisign signature was made by a different key")
+
+// MinisignKey is a minisign or signify public key
+type MinisignKey struct {
+	KeyID  [8]byte
+	Public ed25519.PublicKey
+}
+
+// MinisignSignature is a parsed minisign or signify signature file
+type MinisignSignature struct {
+	Algorithm      [2]byte
+	KeyID          [8]byte
+	Signature      []byte
+	TrustedComment string
+	// signs Signature and TrustedComment, signify has neither
+	GlobalSignature []byte
+}
+
+// keyIDString formats a key ID like minisign does
+func keyIDString(id [8]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// IDString returns the key ID as minisign displays it
+func (k *MinisignKey) IDString() string {
+	return keyIDString(k.KeyID)
+}
+
+// String returns the base64 encoded key, the second line of a minisign public key file
+func (k *MinisignKey) String() string {
+	buf := append(append(algLegacy[:], k.KeyID[:]...), k.Public...)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// KeyIDString returns the ID of the key that made the signature
+func (s *MinisignSignature) KeyIDString() string {
+	return keyIDString(s.KeyID)
+}
+
+// minisignLines splits a minisign file into the base64 lines and the trusted comments
+func minisignLines(text string) (data []string, comments []string) {
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "untrusted comment:"):
+		case strings.HasPrefix(line, "trusted comment: "):
+			comments = append(comments, strings.TrimPrefix(line, "trusted comment: "))
+		default:
+			data = append(data, line)
+		}
+	}
+	return data, comments
+}
+
+// ParseMinisignKey parses a minisign or signify public key, either the whole file or just the base64 line
+func ParseMinisignKey(text string) (*MinisignKey, error) {
+	data, _ := minisignLines(strings.Trim(text, "\x00"))
+	if len(data) != 1 {
+		return nil, errors.New("not a minisign public key")
+	}
+	buf, err := base64.StdEncoding.DecodeString(data[0])
+	if err != nil {
+		return nil, fmt.Errorf("not a minisign public key: %w", err)
+	}
+	if len(buf) != 2+8+ed25519.PublicKeySize || !bytes.Equal(buf[:2], algLegacy[:]) {
+		return nil, errors.New("not a minisign Ed25519 public key")
+	}
+	k := MinisignKey{Public: ed25519.PublicKey(buf[10:])}
+	copy(k.KeyID[:], buf[2:10])
+	return &k, nil
+}
+
+// ParseMinisignSignature parses a minisign or signify signature file
+func ParseMinisignSignature(text string) (*MinisignSignature, error) {
+	data, comments := minisignLines(strings.Trim(text, "\x00"))
+	if len(data) < 1 || len(data) > 2 || len(comments) > 1 || (len(data) == 2) != (len(comments) == 1) {
+		return nil, errors.New("not a minisign signature")
+	}
+	buf, err := base64.StdEncoding.DecodeString(data[0])
+	if err != nil {
+		return nil, fmt.Errorf("not a minisign signature: %w", err)
+	}
+	if len(buf) != 2+8+ed25519.SignatureSize {
+		return nil, errors.New("not a minisign signature, wrong length")
+	}
+	s := MinisignSignature{Signature: buf[10:]}
+	copy(s.Algorithm[:], buf[:2])
+	copy(s.KeyID[:], buf[2:10])
+	if s.Algorithm != algLegacy && s.Algorithm != algPrehashed {
+		return nil, fmt.Errorf("unknown minisign signature algorithm '%s'", s.Algorithm[:])
+	}
+	if len(data) == 2 {
+		s.TrustedComment = comments[0]
+		s.GlobalSignature, err = base64.StdEncoding.DecodeString(data[1])
+		if err != nil || len(s.GlobalSignature) != ed25519.SignatureSize {
+			return nil, errors.New("minisign global signature is invalid")
+		}
+	}
+	return &s, nil
+}
+
+// Verify checks that sig is k's signature over message
+func (k *MinisignKey) Verify(sig *MinisignSignature, message io.Reader) error {
+	var signed []byte
+	var err error
+	if sig.Algorithm == algPrehashed {
+		signed, err = prehash(message)
+	} else {
+		signed, err = io.ReadAll(message)
+	}
+	if err != nil {
+		return err
+	}
+	return k.verify(sig, signed)
+}
+
+func prehash(message io.Reader) ([]byte, error) {
+	h, _ := blake2b.New512(nil)
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verify verifies sig over signed, the message itself or its hash, depending on the algorithm
+func (k *MinisignKey) verify(sig *MinisignSignature, signed []byte) error {
+	if sig.KeyID != k.KeyID {
+		return fmt.Errorf("%w: signed by %s, expected %s", ErrMinisignKeyMismatch, sig.KeyIDString(), k.IDString())
+	}
+	if !ed25519.Verify(k.Public, signed, sig.Signature) {
+		return errors.New("minisign signature does not verify")
+	}
+	if sig.GlobalSignature != nil {
+		global := append(append([]byte{}, sig.Signature...), sig.TrustedComment...)
+		if !ed25519.Verify(k.Public, global, sig.GlobalSignature) {
+			return errors.New("minisign trusted comment does not verify")
+		}
+	}
+	return nil
+}
+
+// MinisignSecretKey is a minisign secret key, for signing
+type MinisignSecretKey struct {
+	MinisignKey
+	private ed25519.PrivateKey
+}
+
+// ErrMinisignPassphrase is returned by ParseMinisignSecretKey if the key is encrypted and passphrase is wrong or missing
+var ErrMinisignPassphrase = errors.New("wrong passphrase for minisign secret key")
+
+// IsEncryptedMinisignSecretKey returns whether text is an encrypted minisign secret key
+func IsEncryptedMinisignSecretKey(text string) bool {
+	data, _ := minisignLines(text)
+	if len(data) != 1 {
+		return false
+	}
+	buf, err := base64.StdEncoding.DecodeString(data[0])
+	return err == nil && len(buf) > 4 && string(buf[2:4]) == "Sc"
+}
+
+// ParseMinisignSecretKey parses a minisign secret key, decrypting it with passphrase if needed
+func ParseMinisignSecretKey(text string, passphrase []byte) (*MinisignSecretKey, error) {
+	data, _ := minisignLines(text)
+	if len(data) != 1 {
+		return nil, errors.New("not a minisign secret key")
+	}
+	buf, err := base64.StdEncoding.DecodeString(data[0])
+	if err != nil {
+		return nil, fmt.Errorf("not a minisign secret key: %w", err)
+	}
+	// sig alg, kdf alg, checksum alg, salt, ops limit, mem limit, then key ID, secret key, checksum
+	const keyLen = 8 + ed25519.PrivateKeySize + 32
+	if len(buf) != 2+2+2+32+8+8+keyLen || !bytes.Equal(buf[:2], algLegacy[:]) || string(buf[4:6]) != "B2" {
+		return nil, errors.New("not a minisign Ed25519 secret key")
+	}
+	kdf := string(buf[2:4])
+	salt := buf[6:38]
+	opslimit := binary.LittleEndian.Uint64(buf[38:46])
+	memlimit := binary.LittleEndian.Uint64(buf[46:54])
+	key := append([]byte{}, buf[54:]...)
+
+	switch kdf {
+	case "\x00\x00":
+	case "Sc":
+		logN, r, p := scryptParams(opslimit, memlimit)
+		stream, err := scrypt.Key(passphrase, salt, 1<<logN, r, p, keyLen)
+		if err != nil {
+			return nil, err
+		}
+		for i := range key {
+			key[i] ^= stream[i]
+		}
+	default:
+		return nil, fmt.Errorf("unknown minisign key derivation '%s'", kdf)
+	}
+
+	sk := MinisignSecretKey{private: ed25519.PrivateKey(key[8 : 8+ed25519.PrivateKeySize])}
+	copy(sk.KeyID[:], key[:8])
+	h, _ := blake2b.New256(nil)
+	h.Write(buf[:2])
+	h.Write(key[:8+ed25519.PrivateKeySize])
+	if !bytes.Equal(h.Sum(nil), key[8+ed25519.PrivateKeySize:]) {
+		if kdf == "Sc" {
+			return nil, ErrMinisignPassphrase
+		}
+		return nil, errors.New("minisign secret key is damaged, checksum mismatch")
+	}
+	sk.Public = sk.private.Public().(ed25519.PublicKey)
+	return &sk, nil
+}
+
+// libsodium's mapping of the scrypt ops and mem limits minisign stores to N, r and p
+func scryptParams(opslimit, memlimit uint64) (logN uint, r, p int) {
+	if opslimit < 32768 {
+		opslimit = 32768
+	}
+	r = 8
+	var maxN uint64
+	if opslimit < memlimit/32 {
+		p = 1
+		maxN = opslimit / uint64(r*4)
+	} else {
+		maxN = memlimit / uint64(r*128)
+	}
+	for logN = 1; logN < 63; logN++ {
+		if uint64(1)<<logN > maxN/2 {
+			break
+		}
+	}
+	if opslimit >= memlimit/32 {
+		maxrp := (opslimit / 4) / (uint64(1) << logN)
+		if maxrp > 0x3fffffff {
+			maxrp = 0x3fffffff
+		}
+		p = int(maxrp) / r
+	}
+	return logN, r, p
+}
+
+// Sign creates a prehashed minisign signature over message
+func (sk *MinisignSecretKey) Sign(message io.Reader, trustedComment string) (*MinisignSignature, error) {
+	hash, err := prehash(message)
+	if err != nil {
+		return nil, err
+	}
+	s := MinisignSignature{Algorithm: algPrehashed, KeyID: sk.KeyID, TrustedComment: trustedComment}
+	s.Signature = ed25519.Sign(sk.private, hash)
+	s.GlobalSignature = ed25519.Sign(sk.private, append(append([]byte{}, s.Signature...), trustedComment...))
+	return &s, nil
+}
+
+// String returns the signature in the minisign file format
+func (s *MinisignSignature) String() string {
+	sig := base64.StdEncoding.EncodeToString(append(append(s.Algorithm[:], s.KeyID[:]...), s.Signature...))
+	out := "untrusted comment: signature from ayy\n" + sig + "\n"
+	if s.GlobalSignature != nil {
+		out += "trusted comment: " + s.TrustedComment + "\n" + base64.StdEncoding.EncodeToString(s.GlobalSignature) + "\n"
+	}
+	return out
+}
+
+// the sections zeroed for embedded minisign signatures. The OpenPGP ones are zeroed too, so
+// both kinds can be embedded. OpenPGP doesn't skip ours though, so minisign has to sign first.
+var minisignSkipSections = []string{".minisig", ".minisig_key", ".sha256_sig", ".sig_key"}
+
+func (ai *AppImage) minisignMessage() (io.Reader, error) {
+	if _, err := ai.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := NewSkipReader(ai.file)
+	for _, name := range minisignSkipSections {
+		if sect := ai.elf.Section(name); sect != nil {
+			r.AddSkip(sect.Offset(), sect.Length())
+		}
+	}
+	return r, nil
+}
+
+// HasMinisign returns whether the AppImage has an embedded minisign signature
+func (ai *AppImage) HasMinisign() bool {
+	sig, _ := ai.ELFSectionAsString(".minisig")
+	key, _ := ai.ELFSectionAsString(".minisig_key")
+	return sig != "" && key != ""
+}
+
+// MinisignKey returns the embedded minisign public key
+func (ai *AppImage) MinisignKey() (*MinisignKey, error) {
+	raw, err := ai.ELFSectionAsString(".minisig_key")
+	if err != nil {
+		return nil, err
+	}
+	return ParseMinisignKey(raw)
+}
+
+// Minisign verifies the embedded minisign signature, and returns the key that made it
+func (ai *AppImage) Minisign() (signedby *MinisignKey, ok bool, err error) {
+	key, err := ai.MinisignKey()
+	if err != nil {
+		return nil, false, err
+	}
+	raw, err := ai.ELFSectionAsString(".minisig")
+	if err != nil {
+		return nil, false, err
+	}
+	sig, err := ParseMinisignSignature(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	if sig.Algorithm != algPrehashed {
+		msg, err := ai.minisignMessage()
+		if err != nil {
+			return nil, false, err
+		}
+		if err := key.Verify(sig, msg); err != nil {
+			return nil, false, err
+		}
+		return key, true, nil
+	}
+	signed, err := ai.cachedDigest("blake2b512-without-minisig", func() ([]byte, error) {
+		msg, err := ai.minisignMessage()
+		if err != nil {
+			return nil, err
+		}
+		return prehash(msg)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if err := key.verify(sig, signed); err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+// VerifyMinisignFile verifies a signature over the whole file, like from a .minisig file next to the AppImage
+func (ai *AppImage) VerifyMinisignFile(sig *MinisignSignature, key *MinisignKey) error {
+	if _, err := ai.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return key.Verify(sig, ai.file)
+}
+
+// SignMinisign embeds a minisign signature and sk's public key.
+// The runtime needs .minisig and .minisig_key sections for that, and the AppImage must have been
+// opened with OpenForWriting(). An existing OpenPGP signature is invalid afterwards.
+func (ai *AppImage) SignMinisign(sk *MinisignSecretKey, trustedComment string) error {
+	if ai.elf.Section(".minisig") == nil || ai.elf.Section(".minisig_key") == nil {
+		return errors.New("the AppImage's runtime has no .minisig and .minisig_key sections")
+	}
+	msg, err := ai.minisignMessage()
+	if err != nil {
+		return err
+	}
+	sig, err := sk.Sign(msg, trustedComment)
+	if err != nil {
+		return err
+	}
+	pub := "untrusted comment: minisign public key " + sk.IDString() + "\n" + sk.MinisignKey.String() + "\n"
+	if err := ai.elf.WriteSection(".minisig_key", []byte(pub)); err != nil {
+		return err
+	}
+	return ai.elf.WriteSection(".minisig", []byte(sig.String()))
+}
@@ -0,0 +1,284 @@
+package appimage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lawl/ayy/elf"
+	"github.com/lawl/ayy/squashfs"
+	"golang.org/x/crypto/openpgp"
+)
+
+type RepackOptions struct {
+	// path inside the AppImage => file on disk to put there.
+	// files that don't exist in the AppImage yet are added, their directory must exist though.
+	// what's replaced must be a regular file, not e.g. a directory or symlink
+	Replace map[string]string
+	// paths inside the AppImage to remove, directories are removed with everything in them
+	Delete []string
+	// re-sign the repacked image with this key. if nil, an existing signature
+	// is removed, as it wouldn't match anymore. minisign signatures are always removed
+	SignKey *openpgp.Entity
+}
+
+// Repack writes a copy of the AppImage to outPath, with the files in its filesystem patched
+// as described by opts. The runtime and its ELF sections are kept as they are, the filesystem
+// is written with the same compression and block size as the original.
+// outPath may be the AppImage itself, it's only replaced once the new one is complete.
+func (ai *AppImage) Repack(outPath string, opts RepackOptions) error {
+	sqfs := ai.SquashFS()
+	if sqfs == nil {
+		return errors.New("only type 2 (squashfs) AppImages can be repacked")
+	}
+	overlay := &overlayFS{
+		base:    ai.FS,
+		replace: make(map[string]string),
+		deleted: make(map[string]bool),
+	}
+	for internal, local := range opts.Replace {
+		p, err := cleanInternalPath(internal)
+		if err != nil {
+			return err
+		}
+		st, err := os.Stat(local)
+		if err != nil {
+			return err
+		}
+		if !st.Mode().IsRegular() {
+			return fmt.Errorf("'%s' is not a regular file", local)
+		}
+		// without following symlinks, the writer doesn't walk into them, so the file would be lost
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			info, err := overlay.lstatBase(dir)
+			if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				return fmt.Errorf("cannot add '%s', '%s' is a symlink in the AppImage, use the path it points to", p, dir)
+			}
+			if err != nil || !info.IsDir() {
+				return fmt.Errorf("cannot add '%s', directory '%s' does not exist in the AppImage", p, dir)
+			}
+		}
+		// a directory would be written as a file, and everything in it lost
+		if info, err := overlay.lstatBase(p); err == nil && !info.Mode().IsRegular() {
+			return fmt.Errorf("cannot replace '%s', it is not a regular file in the AppImage (%s)", p, info.Mode())
+		}
+		overlay.replace[p] = local
+	}
+	for _, internal := range opts.Delete {
+		p, err := cleanInternalPath(internal)
+		if err != nil {
+			return err
+		}
+		if _, err := overlay.lstatBase(p); err != nil {
+			return fmt.Errorf("cannot delete '%s': %w", p, err)
+		}
+		if _, ok := overlay.replace[p]; ok {
+			return fmt.Errorf("'%s' is both replaced and deleted", p)
+		}
+		overlay.deleted[p] = true
+	}
+
+	sb := sqfs.Superblock()
+	fsOpts := squashfs.WriterOptions{
+		Compression: sb.CompressionId,
+		BlockSize:   sb.BlockSize,
+		NoFragments: sb.Flags&squashfs.NoFragments != 0,
+	}
+
+	tmpPath := outPath + ".ayyrepack"
+	out, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	ok := false
+	defer func() {
+		out.Close()
+		if !ok {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	// runtime and sections stay as they are
+	if _, err := io.Copy(out, io.NewSectionReader(ai.file, 0, ai.payloadOffset)); err != nil {
+		return err
+	}
+	if _, err := squashfs.Write(out, overlay, fsOpts); err != nil {
+		return fmt.Errorf("writing squashfs: %w", err)
+	}
+
+	// the old digest doesn't match anymore
+	if ai.HasDigest() {
+		if err := writeDigest(out); err != nil {
+			return fmt.Errorf("writing digest: %w", err)
+		}
+	}
+
+	// signatures that wouldn't match anymore. minisign ones always, only OpenPGP re-signing is supported.
+	// cleared before signing, the OpenPGP signature covers the minisign sections
+	var stale []string
+	if opts.SignKey == nil && ai.HasSignature() {
+		stale = append(stale, ".sha256_sig", ".sig_key")
+	}
+	if ai.HasMinisign() {
+		stale = append(stale, ".minisig", ".minisig_key")
+	}
+	if len(stale) > 0 {
+		el, err := elf.Open(out)
+		if err != nil {
+			return err
+		}
+		for _, name := range stale {
+			if err := el.WriteSection(name, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.SignKey != nil {
+		if err := sign(out, opts.SignKey); err != nil {
+			return fmt.Errorf("signing: %w", err)
+		}
+	}
+
+	if st, err := ai.file.Stat(); err == nil {
+		out.Chmod(st.Mode().Perm())
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		return err
+	}
+	ok = true
+	return nil
+}
+
+func cleanInternalPath(p string) (string, error) {
+	p = path.Clean(strings.TrimLeft(p, "/"))
+	if p == "." || !fs.ValidPath(p) {
+		return "", fmt.Errorf("invalid path '%s'", p)
+	}
+	return p, nil
+}
+
+// overlayFS is an AppImage's filesystem with some files replaced by files on disk,
+// and some removed
+type overlayFS struct {
+	base    fs.FS
+	replace map[string]string
+	deleted map[string]bool
+}
+
+func (o *overlayFS) isDeleted(name string) bool {
+	for p := name; p != "."; p = path.Dir(p) {
+		if o.deleted[p] {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if o.isDeleted(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if local, ok := o.replace[name]; ok {
+		return os.Open(local)
+	}
+	return o.base.Open(name)
+}
+
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if o.isDeleted(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	baseEntries, err := fs.ReadDir(o.base, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	for _, e := range baseEntries {
+		p := path.Join(name, e.Name())
+		if e.Name() == "." || e.Name() == ".." || o.deleted[p] {
+			continue
+		}
+		seen[e.Name()] = true
+		if _, ok := o.replace[p]; ok {
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			replaced, err := o.replacedEntry(p, info)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, replaced)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	// files that are added, not replaced
+	for p := range o.replace {
+		if path.Dir(p) != name || seen[path.Base(p)] {
+			continue
+		}
+		added, err := o.replacedEntry(p, nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, added)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (o *overlayFS) replacedEntry(p string, orig fs.FileInfo) (fs.DirEntry, error) {
+	st, err := os.Stat(o.replace[p])
+	if err != nil {
+		return nil, err
+	}
+	info := replacedInfo{name: path.Base(p), size: st.Size(), modTime: st.ModTime(), mode: st.Mode().Perm()}
+	// replacing e.g. an executable keeps it executable, no matter what's on disk
+	if orig != nil && orig.Mode().IsRegular() {
+		info.mode = orig.Mode()
+	}
+	return fs.FileInfoToDirEntry(info), nil
+}
+
+// lstatBase finds p in the original filesystem without following symlinks
+func (o *overlayFS) lstatBase(p string) (fs.FileInfo, error) {
+	entries, err := fs.ReadDir(o.base, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name() == path.Base(p) {
+			return e.Info()
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// info for files from disk. they end up owned by root,
+// like everything in an AppImage usually is
+type replacedInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+func (r replacedInfo) Name() string       { return r.name }
+func (r replacedInfo) Size() int64        { return r.size }
+func (r replacedInfo) Mode() fs.FileMode  { return r.mode }
+func (r replacedInfo) ModTime() time.Time { return r.modTime }
+func (r replacedInfo) IsDir() bool        { return false }
+func (r replacedInfo) Sys() any           { return nil }
@@ -10,6 +10,12 @@ import (
 )
 
 func (ai *AppImage) Signature() (signedby openpgp.Entity, ok bool, err error) {
+	return ai.SignatureWithKeyring(nil)
+}
+
+// SignatureWithKeyring is like Signature(), but also verifies with the keys in trusted,
+// not only with the key embedded in .sig_key. The keys in trusted are preferred.
+func (ai *AppImage) SignatureWithKeyring(trusted openpgp.EntityList) (signedby openpgp.Entity, ok bool, err error) {
 
 	rawkey, err := ai.ELFSectionAsString(".sig_key")
 	if err != nil {
@@ -31,10 +37,11 @@ func (ai *AppImage) Signature() (signedby openpgp.Entity, ok bool, err error) {
 
 	tocheck := fmt.Sprintf("%x", shabytes) // yes, really...
 
-	keyring, err := openpgp.ReadArmoredKeyRing(keyRingReader)
-	if err != nil {
+	embedded, err := openpgp.ReadArmoredKeyRing(keyRingReader)
+	if err != nil && len(trusted) == 0 {
 		return openpgp.Entity{}, false, err
 	}
+	keyring := append(append(openpgp.EntityList{}, trusted...), embedded...)
 	entity, err := openpgp.CheckArmoredDetachedSignature(keyring, strings.NewReader(tocheck), signature)
 	if err != nil {
 		return openpgp.Entity{}, false, err
@@ -48,6 +55,10 @@ func (ai *AppImage) Signature() (signedby openpgp.Entity, ok bool, err error) {
 // they were entirely 0x00 bytes. That's because this hash
 // is later signed and stuffed into exactly these sections
 func (ai *AppImage) SHA256WithoutSignature() ([]byte, error) {
+	return ai.cachedDigest("sha256-without-signature", ai.sha256WithoutSignature)
+}
+
+func (ai *AppImage) sha256WithoutSignature() ([]byte, error) {
 	if _, err := ai.file.Seek(0, io.SeekStart); err != nil {
 		fmt.Println(err)
 		return nil, err
@@ -0,0 +1,348 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/lawl/ayy/appimage"
+	"github.com/lawl/ayy/squashfs"
+)
+
+// the audit looks through an AppImage's filesystem and .desktop file for things a normal
+// application has no reason to contain. none of it proves an AppImage is malicious, and a
+// clean audit doesn't prove it's harmless, it runs with all the user's privileges anyway.
+// it's about what gets past the user without running it: extracting, or integrating it into the desktop.
+
+type Severity string
+
+const (
+	// something only a broken or malicious AppImage does, e.g. setuid files
+	SeverityHigh Severity = "high"
+	// unusual and possibly dangerous, e.g. a .desktop file claiming to open web links
+	SeverityMedium Severity = "medium"
+	// worth knowing, but common in legitimate AppImages
+	SeverityLow Severity = "low"
+)
+
+func (s Severity) rank() int {
+	switch s {
+	case SeverityHigh:
+		return 3
+	case SeverityMedium:
+		return 2
+	case SeverityLow:
+		return 1
+	}
+	return 0
+}
+
+// AtLeast returns whether s is as severe as min, or more
+func (s Severity) AtLeast(min Severity) bool {
+	return s.rank() >= min.rank()
+}
+
+// ParseSeverity parses "high", "medium" or "low"
+func ParseSeverity(s string) (Severity, error) {
+	sev := Severity(strings.ToLower(s))
+	if sev.rank() == 0 {
+		return "", fmt.Errorf("unknown severity '%s', must be high, medium or low", s)
+	}
+	return sev, nil
+}
+
+// Finding is one suspicious thing the audit found
+type Finding struct {
+	Severity Severity `json:"severity"`
+	// short name of the check, e.g. "setuid"
+	Rule string `json:"rule"`
+	// path inside the AppImage, empty if the finding isn't about a specific file
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail"`
+}
+
+func (f Finding) String() string {
+	if f.Path == "" {
+		return fmt.Sprintf("%s: %s", f.Rule, f.Detail)
+	}
+	return fmt.Sprintf("%s: %s: %s", f.Rule, f.Path, f.Detail)
+}
+
+// Report is the result of auditing an AppImage
+type Report struct {
+	Path     string              `json:"path"`
+	ID       appimage.AppImageID `json:"id,omitempty"`
+	Findings []Finding           `json:"findings"`
+}
+
+func (r *Report) add(sev Severity, rule, p, format string, a ...interface{}) {
+	r.Findings = append(r.Findings, Finding{sev, rule, p, fmt.Sprintf(format, a...)})
+}
+
+// Highest returns the severity of the worst finding, an empty string if there are none
+func (r *Report) Highest() Severity {
+	var max Severity
+	for _, f := range r.Findings {
+		if f.Severity.rank() > max.rank() {
+			max = f.Severity
+		}
+	}
+	return max
+}
+
+// AtLeast returns the findings that are at least as severe as min
+func (r *Report) AtLeast(min Severity) []Finding {
+	var res []Finding
+	for _, f := range r.Findings {
+		if f.Severity.AtLeast(min) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// ErrFindings is wrapped by the error Check() returns
+var ErrFindings = errors.New("audit found suspicious content")
+
+// Check audits ai and returns an error wrapping ErrFindings if anything at least as severe as min was found
+func Check(ai *appimage.AppImage, path string, min Severity) error {
+	r, err := Audit(ai, path)
+	if err != nil {
+		return err
+	}
+	found := r.AtLeast(min)
+	if len(found) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(found))
+	for i, f := range found {
+		msgs[i] = fmt.Sprintf("%s (%s)", f, f.Severity)
+	}
+	return fmt.Errorf("%w: %s", ErrFindings, strings.Join(msgs, "; "))
+}
+
+// Audit scans the filesystem and the .desktop file of ai, which was opened from path.
+// Findings are sorted by severity, the most severe first.
+func Audit(ai *appimage.AppImage, path string) (*Report, error) {
+	r := Report{Path: path, ID: ai.ID(), Findings: []Finding{}}
+	if err := r.scanFS(ai.FS, "."); err != nil {
+		return nil, err
+	}
+	r.scanDesktop(ai)
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		return r.Findings[i].Severity.rank() > r.Findings[j].Severity.rank()
+	})
+	return &r, nil
+}
+
+// scanFS checks everything below dir
+func (r *Report) scanFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return fmt.Errorf("reading '%s': %w", dir, err)
+	}
+	for _, e := range entries {
+		// squashfs.SquashFS lists these too
+		if e.Name() == "." || e.Name() == ".." {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("reading '%s': %w", p, err)
+		}
+		r.checkFile(p, info)
+		if info.IsDir() {
+			if err := r.scanFS(fsys, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Report) checkFile(p string, info fs.FileInfo) {
+	mode := info.Mode()
+
+	if mode&fs.ModeSetuid != 0 {
+		r.add(SeverityHigh, "setuid", p, "is setuid, owned by uid %d", owner(info))
+	}
+	if mode&fs.ModeSetgid != 0 && !mode.IsDir() {
+		r.add(SeverityHigh, "setgid", p, "is setgid")
+	}
+	switch {
+	case mode&fs.ModeCharDevice != 0:
+		r.add(SeverityHigh, "device", p, "is a character device")
+	case mode&fs.ModeDevice != 0:
+		r.add(SeverityHigh, "device", p, "is a block device")
+	case mode&(fs.ModeNamedPipe|fs.ModeSocket) != 0:
+		r.add(SeverityLow, "special-file", p, "is a named pipe or socket")
+	}
+
+	// symlinks are always 0777, that doesn't mean anything
+	if mode&fs.ModeSymlink == 0 && mode.Perm()&0002 != 0 {
+		what := "file"
+		if mode.IsDir() {
+			what = "directory"
+		}
+		if mode.IsDir() && mode&fs.ModeSticky != 0 {
+			r.add(SeverityLow, "world-writable", p, "world writable %s, with the sticky bit", what)
+		} else {
+			r.add(SeverityMedium, "world-writable", p, "world writable %s, anyone can change it once extracted", what)
+		}
+	}
+
+	if mode&fs.ModeSymlink != 0 {
+		r.checkSymlink(p, info)
+	}
+}
+
+func owner(info fs.FileInfo) uint32 {
+	if si, ok := info.Sys().(squashfs.SquashInfo); ok {
+		return si.Uid()
+	}
+	return 0
+}
+
+func (r *Report) checkSymlink(p string, info fs.FileInfo) {
+	si, ok := info.Sys().(squashfs.SquashInfo)
+	if !ok {
+		return
+	}
+	target := si.SymlinkTarget()
+	switch {
+	case target == "":
+		r.add(SeverityLow, "symlink", p, "symlink without a target")
+	case strings.HasPrefix(target, "/"):
+		// mounted, it resolves on the host, so does extracting it
+		r.add(SeverityMedium, "symlink-outside", p, "points to '%s', outside the AppImage", target)
+	case escapes(path.Dir(p), target):
+		// there's no reason to do this with a relative path, except to hide where it points to
+		r.add(SeverityHigh, "symlink-outside", p, "points to '%s', out of the AppImage's root", target)
+	}
+}
+
+// escapes returns whether the relative target of a symlink in dir leads out of the root.
+// symlinks on the way aren't followed, they're checked on their own.
+func escapes(dir, target string) bool {
+	depth := 0
+	if dir != "." {
+		depth = len(strings.Split(dir, "/"))
+	}
+	for _, elem := range strings.Split(target, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// MIME types that a .desktop file claiming would make the AppImage the handler for something it
+// has no business with, e.g. all web links or other executables
+var sensitiveMimeTypes = map[string]string{
+	"x-scheme-handler/http":           "web links",
+	"x-scheme-handler/https":          "web links",
+	"x-scheme-handler/file":           "file URLs",
+	"x-scheme-handler/ftp":            "FTP links",
+	"x-scheme-handler/mailto":         "email links",
+	"x-scheme-handler/ssh":            "ssh links",
+	"x-scheme-handler/terminal":       "terminal links",
+	"inode/directory":                 "directories",
+	"application/x-executable":        "executables",
+	"application/x-sharedlib":         "shared libraries",
+	"application/x-pie-executable":    "executables",
+	"application/x-elf":               "executables",
+	"application/x-shellscript":       "shell scripts",
+	"text/x-shellscript":              "shell scripts",
+	"application/x-sh":                "shell scripts",
+	"application/x-desktop":           ".desktop files",
+	"application/x-appimage":          "AppImages",
+	"application/vnd.appimage":        "AppImages",
+	"application/x-iso9660-appimage":  "AppImages",
+	"application/x-ms-dos-executable": "Windows executables",
+	"application/x-msdownload":        "Windows executables",
+}
+
+func (r *Report) scanDesktop(ai *appimage.AppImage) {
+	matches, _ := fs.Glob(ai.FS, "*.desktop")
+	if len(matches) == 0 {
+		return
+	}
+	if len(matches) > 1 {
+		r.add(SeverityLow, "desktop", "", "%d .desktop files, only '%s' is integrated", len(matches), matches[0])
+	}
+	p := matches[0]
+	df, err := ai.DesktopFile()
+	if err != nil {
+		r.add(SeverityLow, "desktop", p, "can't be parsed: %s", err)
+		return
+	}
+
+	for _, group := range df.Groups() {
+		if group.Name == "Desktop Entry" {
+			r.checkEntry(p, group.KV)
+			continue
+		}
+		// only the main Exec line is rewritten to run the AppImage, actions are installed as they are
+		if exec, ok := group.KV["Exec"]; ok {
+			r.add(SeverityMedium, "desktop-exec", p, "[%s] runs '%s' from the host, not the AppImage", group.Name, program(exec))
+		}
+	}
+}
+
+func (r *Report) checkEntry(p string, kv map[string]string) {
+	if t := kv["Type"]; t != "Application" {
+		r.add(SeverityMedium, "desktop-type", p, "Type is '%s', not Application", t)
+	}
+
+	// integrating replaces AppRun with the AppImage, or the program if there's no AppRun,
+	// so AppRun anywhere but first means whatever is first runs instead
+	toks := strings.Split(kv["Exec"], " ")
+	for i, tok := range toks {
+		if tok == "AppRun" && i > 0 {
+			r.add(SeverityHigh, "desktop-exec", p, "Exec runs '%s', the AppImage only as an argument: %s", toks[0], kv["Exec"])
+			break
+		}
+	}
+	if strings.TrimSpace(kv["Exec"]) == "" {
+		r.add(SeverityLow, "desktop-exec", p, "no Exec line")
+	}
+	if tryExec, ok := kv["TryExec"]; ok {
+		r.add(SeverityLow, "desktop-tryexec", p, "TryExec '%s' is checked on the host, not in the AppImage", tryExec)
+	}
+	if kv["DBusActivatable"] == "true" {
+		r.add(SeverityMedium, "desktop-dbus", p, "DBusActivatable, the desktop starts it through D-Bus instead of Exec")
+	}
+	if kv["Hidden"] == "true" {
+		r.add(SeverityLow, "desktop-hidden", p, "Hidden, the entry is treated as deleted")
+	}
+
+	for _, mime := range strings.Split(kv["MimeType"], ";") {
+		mime = strings.ToLower(strings.TrimSpace(mime))
+		if mime == "" {
+			continue
+		}
+		if what, ok := sensitiveMimeTypes[mime]; ok {
+			r.add(SeverityMedium, "desktop-mimetype", p, "claims to open %s (%s)", what, mime)
+		} else if strings.HasSuffix(mime, "/*") || mime == "*" {
+			r.add(SeverityMedium, "desktop-mimetype", p, "claims to open every '%s' type", mime)
+		} else if strings.HasPrefix(mime, "x-scheme-handler/") {
+			r.add(SeverityLow, "desktop-mimetype", p, "handles '%s' links", strings.TrimPrefix(mime, "x-scheme-handler/"))
+		}
+	}
+}
+
+// program returns the program an Exec line runs
+func program(exec string) string {
+	return strings.Trim(strings.SplitN(strings.TrimSpace(exec), " ", 2)[0], `"`)
+}
@@ -0,0 +1,265 @@
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// program header types we care about
+const (
+	ptLoad    = 1
+	ptDynamic = 2
+	ptInterp  = 3
+)
+
+// dynamic section tags we care about
+const (
+	dtNull    = 0
+	dtNeeded  = 1
+	dtStrtab  = 5
+	dtStrsz   = 10
+	dtRpath   = 15
+	dtRunpath = 29
+)
+
+type ProgramHeader32 struct {
+	Ptype uint32
+	// <32bit sizes>
+	Poffset uint32
+	Pvaddr  uint32
+	Ppaddr  uint32
+	Pfilesz uint32
+	Pmemsz  uint32
+	// </32bit sizes>
+	Pflags uint32
+	// <32bit sizes>
+	Palign uint32
+	// </32bit sizes>
+}
+
+// note that p_flags moved compared to the 32 bit header
+type ProgramHeader64 struct {
+	Ptype  uint32
+	Pflags uint32
+	// <64bit sizes>
+	Poffset uint64
+	Pvaddr  uint64
+	Ppaddr  uint64
+	Pfilesz uint64
+	Pmemsz  uint64
+	Palign  uint64
+	// </64bit sizes>
+}
+
+// ProgramHeaders reads the program headers, i.e. what the kernel and dynamic
+// linker look at to load the file. 32 bit headers are converted to 64 bit ones.
+func (f *File) ProgramHeaders() ([]ProgramHeader64, error) {
+	if f.progs != nil {
+		return f.progs, nil
+	}
+	size := 56
+	if f.Class == 1 {
+		size = 32
+	}
+	if f.PhNum > 0 && int(f.PhEntSize) < size {
+		return nil, fmt.Errorf("invalid program header size %d", f.PhEntSize)
+	}
+
+	progs := make([]ProgramHeader64, 0, f.PhNum)
+	for i := 0; i < int(f.PhNum); i++ {
+		buf := make([]byte, f.PhEntSize)
+		if _, err := f.osFile.ReadAt(buf, int64(f.PhOff)+int64(i)*int64(f.PhEntSize)); err != nil {
+			return nil, fmt.Errorf("reading program header %d: %w", i, err)
+		}
+		prog := ProgramHeader64{}
+		if f.Class == 1 {
+			smolprog := ProgramHeader32{}
+			if err := binary.Read(bytes.NewReader(buf), f.endianness, &smolprog); err != nil {
+				return nil, err
+			}
+			prog.Ptype = smolprog.Ptype
+			prog.Pflags = smolprog.Pflags
+			// <32bit sizes>
+			prog.Poffset = uint64(smolprog.Poffset)
+			prog.Pvaddr = uint64(smolprog.Pvaddr)
+			prog.Ppaddr = uint64(smolprog.Ppaddr)
+			prog.Pfilesz = uint64(smolprog.Pfilesz)
+			prog.Pmemsz = uint64(smolprog.Pmemsz)
+			prog.Palign = uint64(smolprog.Palign)
+			// </32bit sizes>
+		} else {
+			if err := binary.Read(bytes.NewReader(buf), f.endianness, &prog); err != nil {
+				return nil, err
+			}
+		}
+		progs = append(progs, prog)
+	}
+	f.progs = progs
+	return progs, nil
+}
+
+func (f *File) segmentData(prog ProgramHeader64) ([]byte, error) {
+	if prog.Pfilesz > 1<<24 {
+		return nil, fmt.Errorf("segment of %d bytes is unreasonably large", prog.Pfilesz)
+	}
+	buf := make([]byte, prog.Pfilesz)
+	if _, err := f.osFile.ReadAt(buf, int64(prog.Poffset)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Interpreter returns the dynamic linker requested via PT_INTERP, e.g. /lib64/ld-linux-x86-64.so.2.
+// Statically linked files have none, then an empty string is returned.
+func (f *File) Interpreter() (string, error) {
+	progs, err := f.ProgramHeaders()
+	if err != nil {
+		return "", err
+	}
+	for _, prog := range progs {
+		if prog.Ptype != ptInterp {
+			continue
+		}
+		buf, err := f.segmentData(prog)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\x00"), nil
+	}
+	return "", nil
+}
+
+// Dynamic is the interesting parts of the PT_DYNAMIC segment
+type Dynamic struct {
+	// DT_NEEDED, the libraries to load, e.g. libfuse.so.2
+	Needed []string
+	// DT_RPATH and DT_RUNPATH, split at ':'
+	RPath   []string
+	RunPath []string
+}
+
+// Dynamic parses the dynamic section. Statically linked files
+// don't have one, for those nil is returned without error.
+func (f *File) Dynamic() (*Dynamic, error) {
+	progs, err := f.ProgramHeaders()
+	if err != nil {
+		return nil, err
+	}
+	var dynprog *ProgramHeader64
+	for i := range progs {
+		if progs[i].Ptype == ptDynamic {
+			dynprog = &progs[i]
+			break
+		}
+	}
+	if dynprog == nil {
+		return nil, nil
+	}
+	buf, err := f.segmentData(*dynprog)
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		tag int64
+		val uint64
+	}
+	var entries []entry
+	r := bytes.NewReader(buf)
+	for {
+		var e entry
+		if f.Class == 1 {
+			var raw [2]int32
+			if err := binary.Read(r, f.endianness, &raw); err != nil {
+				break
+			}
+			e = entry{tag: int64(raw[0]), val: uint64(uint32(raw[1]))}
+		} else {
+			var raw struct {
+				Tag int64
+				Val uint64
+			}
+			if err := binary.Read(r, f.endianness, &raw); err != nil {
+				break
+			}
+			e = entry{tag: raw.Tag, val: raw.Val}
+		}
+		if e.tag == dtNull {
+			break
+		}
+		entries = append(entries, e)
+	}
+
+	//DT_STRTAB is an address in memory, not an offset in the file
+	var strtabAddr, strsz uint64
+	for _, e := range entries {
+		switch e.tag {
+		case dtStrtab:
+			strtabAddr = e.val
+		case dtStrsz:
+			strsz = e.val
+		}
+	}
+	if strtabAddr == 0 {
+		return nil, errors.New("dynamic section has no string table")
+	}
+	strtabOff, err := f.addrToOffset(strtabAddr)
+	if err != nil {
+		return nil, err
+	}
+	if strsz == 0 || strsz > 1<<24 {
+		return nil, fmt.Errorf("invalid dynamic string table size %d", strsz)
+	}
+	strtab := make([]byte, strsz)
+	if _, err := f.osFile.ReadAt(strtab, int64(strtabOff)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	str := func(off uint64) (string, error) {
+		if off >= uint64(len(strtab)) {
+			return "", fmt.Errorf("string offset %d outside of dynamic string table", off)
+		}
+		end := bytes.IndexByte(strtab[off:], 0)
+		if end < 0 {
+			return "", errors.New("unterminated string in dynamic string table")
+		}
+		return string(strtab[off : off+uint64(end)]), nil
+	}
+
+	dyn := Dynamic{}
+	for _, e := range entries {
+		switch e.tag {
+		case dtNeeded, dtRpath, dtRunpath:
+			s, err := str(e.val)
+			if err != nil {
+				return nil, err
+			}
+			switch e.tag {
+			case dtNeeded:
+				dyn.Needed = append(dyn.Needed, s)
+			case dtRpath:
+				dyn.RPath = append(dyn.RPath, strings.Split(s, ":")...)
+			case dtRunpath:
+				dyn.RunPath = append(dyn.RunPath, strings.Split(s, ":")...)
+			}
+		}
+	}
+	return &dyn, nil
+}
+
+// find the file offset for a virtual address via the PT_LOAD segments
+func (f *File) addrToOffset(addr uint64) (uint64, error) {
+	progs, err := f.ProgramHeaders()
+	if err != nil {
+		return 0, err
+	}
+	for _, prog := range progs {
+		if prog.Ptype == ptLoad && addr >= prog.Pvaddr && addr < prog.Pvaddr+prog.Pfilesz {
+			return addr - prog.Pvaddr + prog.Poffset, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x is not in any loaded segment", addr)
+}
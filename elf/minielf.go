@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 )
@@ -16,6 +17,7 @@ type File struct {
 	ELF64Header
 	endianness binary.ByteOrder
 	sections   []Section
+	progs      []ProgramHeader64
 }
 
 func Open(file *os.File) (*File, error) {
@@ -159,6 +161,9 @@ func readNullTerminatedString(f io.Reader) (string, error) {
 	return string(str), nil
 }
 
+// section type of e.g. .bss, which takes up no space in the file
+const shtNobits = 8
+
 type Section struct {
 	name   string
 	header SectionHeader64
@@ -305,6 +310,32 @@ func (s *Section) Data() ([]byte, error) {
 	return buf, nil
 }
 
+// Write overwrites the contents of the section with data, padded with zero bytes.
+// Sections have a fixed size, data must fit. The file must be opened for writing.
+func (s *Section) Write(data []byte) error {
+	if s.header.Shtype == shtNobits {
+		return fmt.Errorf("ELF section '%s' has no data in the file", s.name)
+	}
+	if uint64(len(data)) > s.header.Shsize {
+		return fmt.Errorf("%d bytes don't fit into ELF section '%s', it only has room for %d", len(data), s.name, s.header.Shsize)
+	}
+	buf := make([]byte, s.header.Shsize)
+	copy(buf, data)
+	if _, err := s.osFile.WriteAt(buf, int64(s.header.Shoffset)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteSection overwrites the contents of the section called name, see Section.Write()
+func (f *File) WriteSection(name string, data []byte) error {
+	sect := f.Section(name)
+	if sect == nil {
+		return fmt.Errorf("ELF section '%s' not found", name)
+	}
+	return sect.Write(data)
+}
+
 func (s *Section) Offset() int {
 	return int(s.header.Shoffset)
 }
@@ -312,3 +343,64 @@ func (s *Section) Offset() int {
 func (s *Section) Length() int {
 	return int(s.header.Shsize)
 }
+
+// e_machine values we know names for. names are the ones uname -m / the
+// AppImage tooling uses, not Go's
+var machineNames = map[uint16]string{
+	3:   "i386",
+	8:   "mips",
+	20:  "ppc",
+	21:  "ppc64",
+	22:  "s390x",
+	40:  "armhf",
+	62:  "x86_64",
+	183: "aarch64",
+	243: "riscv64",
+	258: "loongarch64",
+}
+
+// Arch returns the architecture the ELF was built for, e.g. "x86_64" or "aarch64".
+// Unknown machines are returned as "unknown (0x..)"
+func (f *File) Arch() string {
+	name, ok := machineNames[f.Machine]
+	if !ok {
+		return fmt.Sprintf("unknown (0x%x)", f.Machine)
+	}
+	// ppc64 is big endian unless stated otherwise
+	if name == "ppc64" && f.endianness == binary.LittleEndian {
+		return "ppc64le"
+	}
+	// EM_S390 is both, the class tells them apart
+	if name == "s390x" && f.Class == 1 {
+		return "s390"
+	}
+	return name
+}
+
+// Bits returns 32 or 64, depending on the ELF class
+func (f *File) Bits() int {
+	if f.Class == 1 {
+		return 32
+	}
+	return 64
+}
+
+// ReadArch reads only the start of the ELF header, to cheaply tell which
+// architecture and class a file is for. See File.Arch() and File.Bits()
+func ReadArch(r io.ReaderAt) (arch string, bits int, err error) {
+	buf := make([]byte, 20)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return "", 0, err
+	}
+	if !bytes.Equal(buf[:4], []byte("\x7FELF")) {
+		return "", 0, errors.New("Not an ELF file, invalid magic bytes")
+	}
+	f := File{}
+	f.Class = buf[4]
+	f.endianness = binary.LittleEndian
+	if buf[5] == 2 {
+		f.endianness = binary.BigEndian
+	}
+	f.Machine = f.endianness.Uint16(buf[18:20])
+	return f.Arch(), f.Bits(), nil
+}
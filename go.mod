@@ -2,4 +2,10 @@ module github.com/lawl/ayy
 
 go 1.18
 
-require golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
+require (
+	github.com/klauspost/compress v1.15.15
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
+	golang.org/x/term v0.5.0
+)
+
+require golang.org/x/sys v0.5.0 // indirect
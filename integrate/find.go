@@ -55,6 +55,9 @@ func AppDir() string {
 func List() (list []string, nNotAppImage int) {
 	var appList []string
 	filepath.Walk(AppDir(), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -9,9 +9,13 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/lawl/ayy/appimage"
+	"github.com/lawl/ayy/audit"
+	"github.com/lawl/ayy/policy"
 	"github.com/lawl/ayy/squashfs"
+	"github.com/lawl/ayy/trust"
 	"github.com/lawl/ayy/xdg"
 )
 
@@ -67,7 +71,7 @@ func Integrate(appimgPath string) (err error) {
 
 	icon, err := findIcon(ai)
 	if err != nil {
-		return fmt.Errorf("Unable to find icon: ", err)
+		return fmt.Errorf("Unable to find icon: %w", err)
 	}
 
 	appDir := AppDir()
@@ -212,8 +216,18 @@ func rewriteExecLine(exec, newbin string) string {
 	return strings.Join(toks, " ")
 }
 
+// Options change how Install(), Upgrade() and MoveToApplications() behave
+type Options struct {
+	// install AppImages built for a different architecture than this machine
+	Force bool
+	// refuse AppImages the audit finds something at least this severe in, empty to not audit
+	Audit audit.Severity
+	// called after installing an AppImage signed by a new key, that the trusted key certified
+	KeyRotated func(id appimage.AppImageID, r trust.Rotation)
+}
+
 //newPath may be an empty string, in that case MoveToApplications will decide this itself
-func MoveToApplications(appImagePath string, newPath string, replace bool) (retNewPath string, err error) {
+func MoveToApplications(appImagePath string, newPath string, replace bool, opts Options) (retNewPath string, err error) {
 	appDir := AppDir()
 	if err := ensureExists(appDir); err != nil {
 		return "", err
@@ -225,6 +239,25 @@ func MoveToApplications(appImagePath string, newPath string, replace bool) (retN
 	}
 	defer ai.Close()
 
+	if !opts.Force {
+		if err := ai.CheckArch(); err != nil {
+			return "", err
+		}
+	}
+
+	// a broken download is never worth installing, not even with force
+	if ai.HasDigest() {
+		if _, err := ai.VerifyDigest(); err != nil {
+			return "", err
+		}
+	}
+
+	if opts.Audit != "" {
+		if err := audit.Check(ai, appImagePath, opts.Audit); err != nil {
+			return "", err
+		}
+	}
+
 	//check if this is upgrading an existing image
 	path, foundExisting, err := FindImageById(ai.ID())
 
@@ -236,45 +269,95 @@ func MoveToApplications(appImagePath string, newPath string, replace bool) (retN
 		}
 	}
 
+	// the key of the installed image, for images installed before the trust store existed
+	var oldKey *trust.Key
 	if foundExisting && err == nil {
 		newPath = path
 		oldai, err := appimage.Open(path)
 		if err != nil {
 			return "", fmt.Errorf("Found existing AppImage '%s', with same ID '%s', but couldn't open it, refusing installation for security reasons: %s", path, ai.ID(), err)
 		}
-		if oldai.HasSignature() {
-			oldkey, err := oldai.ELFSectionAsString(".sig_key")
+		defer oldai.Close()
+		if store, err := trust.Load(); err == nil && store.Get(ai.ID()) == nil {
+			oldKey, err = trust.Signer(oldai)
 			if err != nil {
 				return "", fmt.Errorf("Found existing AppImage '%s', with same ID '%s', read old signature, refusing installation for security reasons: %s", path, ai.ID(), err)
 			}
-			newkey, err := ai.ELFSectionAsString(".sig_key")
-			if err != nil {
-				return "", fmt.Errorf("Couldn't read signature of '%s', ID '%s', refusing installation for security reasons: %s", path, ai.ID(), err)
-			}
-			if oldkey != newkey {
-				return "", fmt.Errorf("Found existing AppImage '%s', with same ID '%s', but different signature, WILL NOT PROCEED WITH INSTALLATION: %s", path, ai.ID(), err)
-			}
-
-			_, ok, err := ai.Signature()
-			if err != nil || !ok {
-				return "", fmt.Errorf("AppImage '%s', with ID '%s', has a signature that does not verify, WILL NOT PROCEED WITH INSTALLATION: %s", path, ai.ID(), err)
-			}
 		}
 	} else if foundExisting && err != nil {
 		return "", fmt.Errorf("Found existing AppImage '%s', with same ID '%s', but an error occured, refusing installation for security reasons: %s", path, ai.ID(), err)
 	}
-	if replace {
-		err = os.Rename(appImagePath, newPath)
-	} else {
-		err = os.Link(appImagePath, newPath)
-	}
 
+	// the trust store still knows the key if the old file is gone
+	key, err := trust.FileSigner(ai, appImagePath)
 	if err != nil {
 		return "", err
 	}
+	pol, err := policy.Load()
+	if err != nil {
+		return "", err
+	}
+	if err := policy.Join(pol.Check(ai, key)); err != nil {
+		return "", err
+	}
+	sum, err := ai.SHA256()
+	if err != nil {
+		return "", err
+	}
+	proofPath := appImagePath + trust.RotationSuffix
+	proof, err := trust.ReadKeys(proofPath)
+	if err != nil {
+		return "", err
+	}
+	var rotation *trust.Rotation
+	err = trust.Update(func(store *trust.Store) error {
+		store.Remember(ai.ID(), oldKey)
+		if err := store.Check(ai.ID(), key); err != nil {
+			r, rerr := store.Rotate(ai.ID(), key, proof, filepath.Base(proofPath))
+			if rerr != nil {
+				return rerr
+			}
+			if r == nil {
+				return err
+			}
+			rotation = r
+		}
+		var err error
+		if replace {
+			err = os.Rename(appImagePath, newPath)
+		} else {
+			err = os.Link(appImagePath, newPath)
+		}
+		if err != nil {
+			return err
+		}
+		store.Remember(ai.ID(), key)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if rotation != nil && opts.KeyRotated != nil {
+		opts.KeyRotated(ai.ID(), *rotation)
+	}
 	if err := os.Chmod(newPath, 0755); err != nil {
 		return "", fmt.Errorf("Couldn't set executable permissions on AppImage '%s': %s\n", appImagePath, err)
 	}
+	info, err := os.Stat(newPath)
+	if err != nil {
+		return "", err
+	}
+	rec := Record{
+		Path:        newPath,
+		SHA256:      fmt.Sprintf("%x", sum),
+		Size:        info.Size(),
+		InstalledAt: time.Now().UTC(),
+		Signers:     key.Fingerprints(),
+		Detached:    key != nil && !ai.HasSignature() && !ai.HasMinisign(),
+	}
+	if err := saveRecord(ai.ID(), &rec); err != nil {
+		return "", fmt.Errorf("recording installation of '%s': %w", newPath, err)
+	}
 
 	return newPath, nil
 }
@@ -290,8 +373,8 @@ func IsIntegrated(ai *appimage.AppImage) bool {
 // the original file is left untouched.
 // Optionally optionalNewPath may specify where. If an empty
 // string is supplied, the new path will be figure out automatically
-func Install(appImagePath, optionalNewPath string) (newPath string, err error) {
-	path, err := MoveToApplications(appImagePath, optionalNewPath, false)
+func Install(appImagePath, optionalNewPath string, opts Options) (newPath string, err error) {
+	path, err := MoveToApplications(appImagePath, optionalNewPath, false, opts)
 	if err != nil {
 		return "", err
 	}
@@ -307,8 +390,8 @@ func Install(appImagePath, optionalNewPath string) (newPath string, err error) {
 // location
 // Optionally optionalNewPath may specify where. If an empty
 // string is supplied, the new path will be figure out automatically
-func Upgrade(appImagePath, optionalNewPath string) (newPath string, err error) {
-	path, err := MoveToApplications(appImagePath, optionalNewPath, true)
+func Upgrade(appImagePath, optionalNewPath string, opts Options) (newPath string, err error) {
+	path, err := MoveToApplications(appImagePath, optionalNewPath, true, opts)
 	if err != nil {
 		return "", err
 	}
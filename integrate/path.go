@@ -17,6 +17,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/lawl/ayy/appimage"
+	"github.com/lawl/ayy/policy"
 )
 
 const wrapperHeader = "#!/bin/sh\n" +
@@ -30,6 +33,19 @@ func CreatePathWrapper(name, appimgpath string) error {
 		return errors.New("a file with the specified name already exists in ~/.local/bin/. not creating " + wrapperpath)
 	}
 
+	ai, err := appimage.Open(appimgpath)
+	if err != nil {
+		return err
+	}
+	defer ai.Close()
+	violations, err := policy.Evaluate(ai, appimgpath)
+	if err != nil {
+		return err
+	}
+	if err := policy.Join(violations); err != nil {
+		return err
+	}
+
 	// there is an argument that we should just symlink here
 	// however a symlink has the issue, that we later won't be able
 	// to tell if it has been created by us or the user.
@@ -44,7 +60,7 @@ func CreatePathWrapper(name, appimgpath string) error {
 
 	wrapper := fmt.Sprintf(wrapperHeader+`%s "$@"`+"\n", appimgpath)
 
-	err := os.WriteFile(wrapperpath, []byte(wrapper), 0755)
+	err = os.WriteFile(wrapperpath, []byte(wrapper), 0755)
 	return err
 }
 
@@ -0,0 +1,132 @@
+package integrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lawl/ayy/appimage"
+	"github.com/lawl/ayy/xdg"
+)
+
+// what an AppImage looked like when it was installed, so 'ayy verify' notices if it changed since
+
+// Record describes an installed AppImage
+type Record struct {
+	Path        string    `json:"path"`
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	InstalledAt time.Time `json:"installed_at"`
+	// fingerprints of the keys whose signatures were verified at install time, including detached ones
+	Signers []string `json:"signers,omitempty"`
+	// whether all of them were detached signatures, those stay behind when installing
+	Detached bool `json:"detached,omitempty"`
+}
+
+type records struct {
+	Images map[appimage.AppImageID]*Record `json:"images"`
+}
+
+// RecordsPath returns where install records are saved
+func RecordsPath() string {
+	return filepath.Join(xdg.Get(xdg.STATE_HOME), "ayy", "installed.json")
+}
+
+func loadRecords() (*records, error) {
+	r := records{Images: make(map[appimage.AppImageID]*Record)}
+	buf, err := os.ReadFile(RecordsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return &r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &r); err != nil {
+		return nil, fmt.Errorf("install records '%s' are damaged: %w", RecordsPath(), err)
+	}
+	if r.Images == nil {
+		r.Images = make(map[appimage.AppImageID]*Record)
+	}
+	return &r, nil
+}
+
+var recordsMu sync.Mutex
+
+// updateRecords loads the records, calls fn and saves them, with other ayy processes locked out
+func updateRecords(fn func(r *records)) error {
+	recordsMu.Lock()
+	defer recordsMu.Unlock()
+
+	p := RecordsPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(p+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("locking install records: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	r, err := loadRecords()
+	if err != nil {
+		return err
+	}
+	fn(r)
+	buf, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// RecordForPath returns the install record of the AppImage installed at path and the ID it was installed with,
+// nil if there is none. Unlike the ID, the path doesn't change when someone modifies the file.
+func RecordForPath(path string) (appimage.AppImageID, *Record, error) {
+	r, err := loadRecords()
+	if err != nil {
+		return "", nil, err
+	}
+	path = cleanPath(path)
+	for id, rec := range r.Images {
+		if cleanPath(rec.Path) == path {
+			return id, rec, nil
+		}
+	}
+	return "", nil, nil
+}
+
+func cleanPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+func saveRecord(id appimage.AppImageID, rec *Record) error {
+	return updateRecords(func(r *records) {
+		r.Images[id] = rec
+	})
+}
+
+// ForgetRecord removes the install record of the AppImage installed at path
+func ForgetRecord(path string) error {
+	return updateRecords(func(r *records) {
+		for id, rec := range r.Images {
+			if cleanPath(rec.Path) == cleanPath(path) {
+				delete(r.Images, id)
+			}
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package integrate
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lawl/ayy/appimage"
+	"github.com/lawl/ayy/trust"
+)
+
+// check results
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// Check is the result of one check of an installed AppImage
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Verification is the result of re-verifying an installed AppImage
+type Verification struct {
+	Path   string              `json:"path"`
+	ID     appimage.AppImageID `json:"id,omitempty"`
+	Name   string              `json:"name,omitempty"`
+	OK     bool                `json:"ok"`
+	Checks []Check             `json:"checks"`
+}
+
+func (v *Verification) add(name, status, format string, a ...interface{}) {
+	v.Checks = append(v.Checks, Check{name, status, fmt.Sprintf(format, a...)})
+	if status == CheckFailed {
+		v.OK = false
+	}
+}
+
+// Verify checks that the AppImage installed at path is still what was installed:
+// its signatures, its embedded digest and the SHA-256 recorded at install time.
+// Nothing is taken from the digest cache, call appimage.DisableDigestCache() first.
+func Verify(path string) *Verification {
+	v := Verification{Path: path, OK: true}
+	ai, err := appimage.Open(path)
+	if err != nil {
+		v.add("open", CheckFailed, "%s", err)
+		return &v
+	}
+	defer ai.Close()
+	v.ID = ai.ID()
+	v.Name = ai.DesktopEntry("Name")
+
+	// by path, the ID is read from the file and changes if the file is modified
+	recID, rec, err := RecordForPath(path)
+	if err != nil {
+		v.add("record", CheckFailed, "%s", err)
+		return &v
+	}
+
+	v.verifySignature(ai, rec)
+
+	if ai.HasDigest() {
+		if _, err := ai.VerifyDigest(); err != nil {
+			v.add("digest", CheckFailed, "%s", err)
+		} else {
+			v.add("digest", CheckOK, "embedded MD5 digest matches")
+		}
+	} else {
+		v.add("digest", CheckSkipped, "no embedded digest")
+	}
+
+	if rec == nil {
+		v.add("record", CheckSkipped, "installed before ayy recorded installs, or by another tool")
+		return &v
+	}
+	installed := rec.InstalledAt.Local().Format("2006-01-02 15:04")
+	if recID != v.ID {
+		v.add("record", CheckFailed, "ID is '%s', but was '%s' when installed on %s, the file was modified", v.ID, recID, installed)
+		return &v
+	}
+	sum, err := ai.SHA256()
+	if err != nil {
+		v.add("record", CheckFailed, "%s", err)
+		return &v
+	}
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		v.add("record", CheckFailed, "%s", err)
+	case info.Size() != rec.Size:
+		v.add("record", CheckFailed, "size is %d bytes, but was %d when installed on %s, the file was modified", info.Size(), rec.Size, installed)
+	case fmt.Sprintf("%x", sum) != rec.SHA256:
+		v.add("record", CheckFailed, "SHA-256 is %x, but was %s when installed on %s, the file was modified", sum, rec.SHA256, installed)
+	default:
+		v.add("record", CheckOK, "SHA-256 matches the one recorded at install time")
+	}
+	return &v
+}
+
+func (v *Verification) verifySignature(ai *appimage.AppImage, rec *Record) {
+	key, err := trust.FileSigner(ai, v.Path)
+	if err != nil {
+		v.add("signature", CheckFailed, "%s", err)
+		return
+	}
+	store, err := trust.Load()
+	if err != nil {
+		v.add("signature", CheckFailed, "%s", err)
+		return
+	}
+	if key == nil && rec != nil && len(rec.Signers) > 0 {
+		if !rec.Detached {
+			v.add("signature", CheckFailed, "signed by %s when installed, the signature was removed since", strings.Join(rec.Signers, " and "))
+			return
+		}
+		// detached signatures stay behind when installing, the recorded SHA-256 vouches for the file now
+		if trusted := store.Get(v.ID); trusted != nil && !contains(rec.Signers, trusted.Fingerprint) {
+			v.add("signature", CheckFailed, "signed by %s when installed, which isn't the key trusted for '%s' anymore", strings.Join(rec.Signers, " and "), v.ID)
+			return
+		}
+		v.add("signature", CheckOK, "detached signature by %s, verified when installed", strings.Join(rec.Signers, " and "))
+		return
+	}
+	if err := store.Check(v.ID, key); err != nil {
+		v.add("signature", CheckFailed, "%s", err)
+		return
+	}
+	if key == nil {
+		v.add("signature", CheckSkipped, "not signed")
+		return
+	}
+	v.add("signature", CheckOK, "signed by %s", strings.Join(key.Fingerprints(), " and "))
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
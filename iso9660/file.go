@@ -0,0 +1,87 @@
+package iso9660
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// FileInfo implements fs.FileInfo. Sys() returns the FileInfo itself, which
+// has Uid(), Gid() and SymlinkTarget() like squashfs.SquashInfo, and DeviceNumber() like squashfs.DeviceInfo
+type FileInfo struct {
+	rec  *record
+	name string
+}
+
+func (f FileInfo) Name() string       { return f.name }
+func (f FileInfo) Size() int64        { return f.rec.size }
+func (f FileInfo) Mode() fs.FileMode  { return f.rec.mode }
+func (f FileInfo) ModTime() time.Time { return f.rec.modTime }
+func (f FileInfo) IsDir() bool        { return f.rec.dir }
+func (f FileInfo) Sys() any           { return f }
+
+func (f FileInfo) Uid() uint32 { return f.rec.uid }
+func (f FileInfo) Gid() uint32 { return f.rec.gid }
+
+// SymlinkTarget returns where a symlink points to, or an empty string for anything else
+func (f FileInfo) SymlinkTarget() string { return f.rec.symlink }
+
+// DeviceNumber returns the major and minor number of a device node, 0 for anything else
+func (f FileInfo) DeviceNumber() (major, minor uint32) { return f.rec.devMajor, f.rec.devMinor }
+
+// DirEntry implements fs.DirEntry
+type DirEntry struct {
+	info FileInfo
+}
+
+func (d DirEntry) Name() string               { return d.info.name }
+func (d DirEntry) IsDir() bool                { return d.info.IsDir() }
+func (d DirEntry) Type() fs.FileMode          { return d.info.Mode().Type() }
+func (d DirEntry) Info() (fs.FileInfo, error) { return d.info, nil }
+
+// File is a regular file, opened with FS.Open()
+type File struct {
+	info FileInfo
+	*io.SectionReader
+}
+
+func (f *File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *File) Close() error {
+	return nil //noop
+}
+
+// Directory is a directory, opened with FS.Open(). It implements fs.ReadDirFile
+type Directory struct {
+	info       FileInfo
+	entries    []fs.DirEntry
+	readDirPos int
+}
+
+func (d *Directory) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *Directory) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("cannot Read() directory")}
+}
+
+func (d *Directory) Close() error {
+	return nil //noop
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *Directory) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.readDirPos:]
+	if n > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(remaining) {
+		n = len(remaining)
+	}
+	d.readDirPos += n
+	return remaining[:n], nil
+}
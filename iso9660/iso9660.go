@@ -0,0 +1,417 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// read-only ISO 9660 with Rock Ridge extensions, as used by type 1 AppImages
+// docs: ECMA-119 https://www.ecma-international.org/publications-and-standards/standards/ecma-119/
+// Rock Ridge: SUSP (IEEE P1281) and RRIP (IEEE P1282)
+
+// volume descriptors and directory records never cross sectors of this size,
+// no matter the logical block size
+const sectorSize = 2048
+
+// how many symlinks we follow while resolving a path, same as linux
+const maxSymlinkHops = 40
+
+type FS struct {
+	reader    io.ReaderAt
+	size      int64
+	blockSize int64
+	volumeID  string
+	root      *record
+
+	rockRidge bool
+	// bytes to skip at the start of each system use area, from the SP entry
+	suspSkip int
+
+	dirsLock sync.Mutex
+	dirs     map[uint32][]*record
+}
+
+// New opens the ISO 9660 image in reader, which has size bytes. The image
+// starts at offset 0, the first 16 sectors are the system area that
+// type 1 AppImages put the runtime into.
+func New(reader io.ReaderAt, size int64) (*FS, error) {
+	s := FS{reader: reader, size: size, dirs: make(map[uint32][]*record)}
+
+	found := false
+	// volume descriptors start at sector 16, and end with a terminator.
+	// there's usually only a handful, don't read garbage forever.
+	for sector := int64(16); sector < 16+64 && !found; sector++ {
+		buf := make([]byte, sectorSize)
+		if _, err := reader.ReadAt(buf, sector*sectorSize); err != nil {
+			return nil, fmt.Errorf("reading volume descriptor: %w", err)
+		}
+		if string(buf[1:6]) != "CD001" {
+			return nil, errors.New("not an ISO 9660 image, magic bytes dont match")
+		}
+		switch buf[0] {
+		case 255: // terminator
+			return nil, errors.New("ISO 9660 image has no primary volume descriptor")
+		case 1: // primary. the others are boot records, joliet, etc.
+			found = true
+			s.blockSize = int64(binary.LittleEndian.Uint16(buf[128:130]))
+			s.volumeID = strings.TrimRight(string(buf[40:72]), " ")
+			if s.blockSize != 512 && s.blockSize != 1024 && s.blockSize != 2048 {
+				return nil, fmt.Errorf("invalid logical block size %d", s.blockSize)
+			}
+			root, _, err := parseRecord(buf[156:190])
+			if err != nil {
+				return nil, fmt.Errorf("reading root directory record: %w", err)
+			}
+			if !root.dir {
+				return nil, errors.New("root directory record is not a directory")
+			}
+			root.name = "."
+			s.root = root
+		}
+	}
+	if !found {
+		return nil, errors.New("ISO 9660 image has no primary volume descriptor")
+	}
+
+	if err := s.detectRockRidge(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Rock Ridge announces itself with a SP entry at the start of the
+// system use area of the root directory's "." record
+func (s *FS) detectRockRidge() error {
+	buf, err := s.readExtents(s.root)
+	if err != nil {
+		return fmt.Errorf("reading root directory: %w", err)
+	}
+	if len(buf) == 0 || int(buf[0]) > len(buf) {
+		return errors.New("root directory is empty")
+	}
+	dot, susp, err := parseRecord(buf[:buf[0]])
+	if err != nil {
+		return fmt.Errorf("reading root directory: %w", err)
+	}
+	if len(susp) >= 7 && string(susp[0:2]) == "SP" && susp[4] == 0xBE && susp[5] == 0xEF {
+		s.rockRidge = true
+		s.suspSkip = int(susp[6])
+		if err := s.applyRockRidge(dot, susp, true); err != nil {
+			return err
+		}
+		// "." of the root has the root's permissions, owner and mtime
+		dot.name = "."
+		s.root = dot
+	}
+	return nil
+}
+
+// VolumeID returns the label of the image
+func (s *FS) VolumeID() string {
+	return s.volumeID
+}
+
+// RockRidge returns whether the image has Rock Ridge extensions, i.e. long file names,
+// permissions, owners and symlinks. Without, names are limited and everything is read-only.
+func (s *FS) RockRidge() bool {
+	return s.rockRidge
+}
+
+func (s *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	rec, resolved, err := s.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info := FileInfo{rec: rec, name: path.Base(name)}
+	if rec.dir {
+		entries, err := s.readDirEntries(resolved, rec)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &Directory{info: info, entries: entries}, nil
+	}
+	return &File{info: info, SectionReader: io.NewSectionReader(s.extentReader(rec), 0, rec.size)}, nil
+}
+
+func (s *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	rec, resolved, err := s.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !rec.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := s.readDirEntries(resolved, rec)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// ReadLink returns where the symlink name points to
+func (s *FS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	rec, _, err := s.lookup(name, false)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if rec.symlink == "" {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.New("not a symlink")}
+	}
+	return rec.symlink, nil
+}
+
+// readDirEntries lists the directory rec, which is at dirPath. Like in our squashfs,
+// the list starts with "." and "..", the rest is sorted by name
+func (s *FS) readDirEntries(dirPath string, rec *record) ([]fs.DirEntry, error) {
+	children, err := s.readDir(rec)
+	if err != nil {
+		return nil, err
+	}
+	parent := s.root
+	if dirPath != "." {
+		if parent, _, err = s.lookup(path.Dir(dirPath), true); err != nil {
+			return nil, err
+		}
+	}
+	entries := make([]fs.DirEntry, 0, len(children)+2)
+	entries = append(entries, DirEntry{FileInfo{rec: rec, name: "."}}, DirEntry{FileInfo{rec: parent, name: ".."}})
+	for _, c := range children {
+		entries = append(entries, DirEntry{FileInfo{rec: c, name: c.name}})
+	}
+	return entries, nil
+}
+
+// lookup finds name, following symlinks on the way. The last component is only followed
+// if followLast is set. Also returns the path name resolved to, without symlinks.
+func (s *FS) lookup(name string, followLast bool) (*record, string, error) {
+	hops := 0
+	return s.walk(name, followLast, &hops)
+}
+
+func (s *FS) walk(name string, followLast bool, hops *int) (*record, string, error) {
+	cur := s.root
+	curPath := "."
+	if name == "." {
+		return cur, curPath, nil
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if !cur.dir {
+			return nil, "", fs.ErrNotExist
+		}
+		children, err := s.readDir(cur)
+		if err != nil {
+			return nil, "", err
+		}
+		var next *record
+		for _, c := range children {
+			if c.name == part {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil, "", fs.ErrNotExist
+		}
+		nextPath := path.Join(curPath, part)
+
+		last := i == len(parts)-1
+		if next.symlink != "" && (!last || followLast) {
+			*hops++
+			if *hops > maxSymlinkHops {
+				return nil, "", errors.New("too many levels of symbolic links")
+			}
+			// absolute symlinks are taken to be relative to the root of the image
+			target := next.symlink
+			if path.IsAbs(target) {
+				target = strings.TrimPrefix(path.Clean(target), "/")
+				if target == "" {
+					target = "."
+				}
+			} else {
+				target = path.Join(curPath, target)
+			}
+			// pointing outside of the image
+			if !fs.ValidPath(target) {
+				return nil, "", fs.ErrNotExist
+			}
+			next, nextPath, err = s.walk(target, true, hops)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		cur = next
+		curPath = nextPath
+	}
+	return cur, curPath, nil
+}
+
+// readDir returns the children of the directory rec, without "." and "..", sorted by name
+func (s *FS) readDir(rec *record) ([]*record, error) {
+	key := rec.extents[0].location
+	s.dirsLock.Lock()
+	children, ok := s.dirs[key]
+	s.dirsLock.Unlock()
+	if ok {
+		return children, nil
+	}
+
+	buf, err := s.readExtents(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	for pos := 0; pos < len(buf); {
+		length := int(buf[pos])
+		if length == 0 {
+			// rest of the sector is padding, records don't cross sectors
+			pos = (pos/sectorSize + 1) * sectorSize
+			continue
+		}
+		if pos+length > len(buf) {
+			return nil, errors.New("directory record exceeds directory")
+		}
+		child, susp, err := parseRecord(buf[pos : pos+length])
+		if err != nil {
+			return nil, err
+		}
+		pos += length
+		if child.name == "\x00" || child.name == "\x01" { // "." and ".."
+			continue
+		}
+		if s.rockRidge {
+			if err := s.applyRockRidge(child, susp, false); err != nil {
+				return nil, err
+			}
+			// relocated directory, it also shows up where it belongs via CL
+			if child.relocated {
+				continue
+			}
+			if child.childLink != 0 {
+				if err := s.resolveChildLink(child); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			child.name = plainName(child.name, child.dir)
+		}
+
+		// files > 4GiB are split into multiple records with the same name
+		if n := len(children); n > 0 && children[n-1].multiExtent && children[n-1].name == child.name {
+			prev := children[n-1]
+			prev.extents = append(prev.extents, child.extents...)
+			prev.size += child.size
+			prev.multiExtent = child.multiExtent
+			continue
+		}
+		children = append(children, child)
+	}
+
+	// hide the directory relocated directories are moved to, they show up where they belong.
+	// it doesn't have a fixed name, but all the tools use rr_moved
+	if rec == s.root && s.rockRidge {
+		for i, c := range children {
+			if c.dir && (c.name == "rr_moved" || c.name == ".rr_moved") {
+				moved, err := s.readDir(c)
+				if err == nil && len(moved) == 0 {
+					children = append(children[:i], children[i+1:]...)
+				}
+				break
+			}
+		}
+	}
+
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+
+	s.dirsLock.Lock()
+	s.dirs[key] = children
+	s.dirsLock.Unlock()
+	return children, nil
+}
+
+// a CL entry turns a file into a directory that was moved elsewhere, because
+// plain ISO 9660 doesn't allow nesting more than 8 levels deep
+func (s *FS) resolveChildLink(child *record) error {
+	buf := make([]byte, sectorSize)
+	if _, err := s.reader.ReadAt(buf, int64(child.childLink)*s.blockSize); err != nil {
+		return fmt.Errorf("reading relocated directory: %w", err)
+	}
+	if int(buf[0]) == 0 {
+		return errors.New("relocated directory is empty")
+	}
+	dot, _, err := parseRecord(buf[:buf[0]])
+	if err != nil {
+		return fmt.Errorf("reading relocated directory: %w", err)
+	}
+	child.extents = dot.extents
+	child.size = dot.size
+	child.dir = true
+	child.mode = fs.ModeDir | child.mode.Perm()
+	return nil
+}
+
+func (s *FS) readExtents(rec *record) ([]byte, error) {
+	// directories are small, don't allocate whatever a corrupt image claims
+	if rec.size > 64<<20 {
+		return nil, fmt.Errorf("directory of %d bytes is unreasonably large", rec.size)
+	}
+	buf := make([]byte, rec.size)
+	if _, err := io.ReadFull(io.NewSectionReader(s.extentReader(rec), 0, rec.size), buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *FS) extentReader(rec *record) io.ReaderAt {
+	if len(rec.extents) == 1 {
+		return io.NewSectionReader(s.reader, int64(rec.extents[0].location)*s.blockSize, rec.size)
+	}
+	return &multiExtentReader{fsys: s, extents: rec.extents}
+}
+
+// reads a file that's split into multiple extents, as if it was one
+type multiExtentReader struct {
+	fsys    *FS
+	extents []extent
+}
+
+func (m *multiExtentReader) ReadAt(p []byte, off int64) (n int, err error) {
+	var start int64
+	for _, e := range m.extents {
+		end := start + int64(e.size)
+		if off < end && len(p) > 0 {
+			want := p
+			if int64(len(want)) > end-off {
+				want = want[:end-off]
+			}
+			nn, err := m.fsys.reader.ReadAt(want, int64(e.location)*m.fsys.blockSize+(off-start))
+			n += nn
+			if err != nil {
+				return n, err
+			}
+			p = p[nn:]
+			off += int64(nn)
+		}
+		start = end
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,322 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type extent struct {
+	location uint32 // in logical blocks
+	size     uint32
+}
+
+// record is a directory record, with the Rock Ridge information applied
+type record struct {
+	name    string
+	extents []extent
+	size    int64
+	dir     bool
+	mode    fs.FileMode
+	uid     uint32
+	gid     uint32
+	modTime time.Time
+	symlink string
+	// PN, device nodes only
+	devMajor, devMinor uint32
+
+	// more records with the same name follow, that continue this file
+	multiExtent bool
+	// RE, the directory was moved here from somewhere deeper in the tree
+	relocated bool
+	// CL, where the directory that belongs here was moved to
+	childLink uint32
+}
+
+// directory record flags
+const (
+	flagDirectory   = 1 << 1
+	flagMultiExtent = 1 << 7
+)
+
+// parseRecord parses a directory record. Returns the record and its system use area,
+// which is where the Rock Ridge entries are.
+func parseRecord(buf []byte) (*record, []byte, error) {
+	if len(buf) < 34 || int(buf[0]) < 34 || int(buf[0]) > len(buf) {
+		return nil, nil, errors.New("directory record too short")
+	}
+	buf = buf[:buf[0]]
+	nameLen := int(buf[32])
+	if 33+nameLen > len(buf) {
+		return nil, nil, errors.New("directory record name exceeds record")
+	}
+
+	// "both-endian" fields, the little endian half comes first
+	rec := record{}
+	rec.extents = []extent{{
+		location: binary.LittleEndian.Uint32(buf[2:6]),
+		size:     binary.LittleEndian.Uint32(buf[10:14]),
+	}}
+	rec.size = int64(rec.extents[0].size)
+	rec.modTime = parseShortTime(buf[18:25])
+	flags := buf[25]
+	rec.dir = flags&flagDirectory != 0
+	rec.multiExtent = flags&flagMultiExtent != 0
+	rec.name = string(buf[33 : 33+nameLen])
+
+	// without Rock Ridge there are no permissions
+	rec.mode = 0555
+	if rec.dir {
+		rec.mode |= fs.ModeDir
+	}
+
+	// the name is padded to an even length
+	suspStart := 33 + nameLen
+	if nameLen%2 == 0 {
+		suspStart++
+	}
+	var susp []byte
+	if suspStart < len(buf) {
+		susp = buf[suspStart:]
+	}
+	return &rec, susp, nil
+}
+
+// names without Rock Ridge look like "FOO.TXT;1". like linux does by default,
+// turn that into "foo.txt"
+func plainName(name string, dir bool) string {
+	name = strings.ToLower(name)
+	if dir {
+		return name
+	}
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// dates in directory records: years since 1900, month, day, hour, minute, second,
+// and the offset from GMT in 15 minute intervals
+func parseShortTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 && b[2] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// dates in volume descriptors, and optionally in TF: "YYYYMMDDHHMMSScc" in ASCII
+// followed by the offset from GMT like above
+func parseLongTime(b []byte) time.Time {
+	digits := string(b[:16])
+	if strings.Trim(digits, "0\x00") == "" {
+		return time.Time{}
+	}
+	num := func(from, to int) int {
+		n, _ := strconv.Atoi(digits[from:to])
+		return n
+	}
+	zone := time.FixedZone("", int(int8(b[16]))*15*60)
+	return time.Date(num(0, 4), time.Month(num(4, 6)), num(6, 8), num(8, 10), num(10, 12), num(12, 14), num(14, 16)*10*int(time.Millisecond), zone)
+}
+
+// POSIX file type bits, as used by the PX entry
+const (
+	sIFMT   = 0170000
+	sIFSOCK = 0140000
+	sIFLNK  = 0120000
+	sIFREG  = 0100000
+	sIFBLK  = 0060000
+	sIFDIR  = 0040000
+	sIFCHR  = 0020000
+	sIFIFO  = 0010000
+)
+
+func unixToFileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & sIFMT {
+	case sIFSOCK:
+		m |= fs.ModeSocket
+	case sIFLNK:
+		m |= fs.ModeSymlink
+	case sIFBLK:
+		m |= fs.ModeDevice
+	case sIFDIR:
+		m |= fs.ModeDir
+	case sIFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case sIFIFO:
+		m |= fs.ModeNamedPipe
+	}
+	if mode&04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// continuation areas can chain, but not forever
+const maxContinuations = 16
+
+// applyRockRidge updates rec with the Rock Ridge entries in its system use area
+func (s *FS) applyRockRidge(rec *record, susp []byte, rootDot bool) error {
+	// the skip from the SP entry applies to everything but where the SP entry itself is
+	if !rootDot {
+		if s.suspSkip > len(susp) {
+			return nil
+		}
+		susp = susp[s.suspSkip:]
+	}
+
+	var name strings.Builder
+	hasName := false
+	var linkParts []string
+	linkContinues := false
+	hasLink := false
+
+	for continuations := 0; ; continuations++ {
+		var ce []byte
+		for len(susp) >= 4 {
+			sig := string(susp[0:2])
+			length := int(susp[2])
+			if length < 4 || length > len(susp) {
+				break
+			}
+			data := susp[4:length]
+			susp = susp[length:]
+
+			switch sig {
+			case "ST": // stop
+				susp = nil
+			case "CE": // continues somewhere else
+				if len(data) >= 24 {
+					ce = data
+				}
+			case "PX": // permissions and owner
+				if len(data) >= 32 {
+					rec.mode = unixToFileMode(binary.LittleEndian.Uint32(data[0:4]))
+					rec.uid = binary.LittleEndian.Uint32(data[16:20])
+					rec.gid = binary.LittleEndian.Uint32(data[24:28])
+				}
+			case "PN": // device number, both-endian high and low halves
+				if len(data) >= 16 {
+					high := binary.LittleEndian.Uint32(data[0:4])
+					low := binary.LittleEndian.Uint32(data[8:12])
+					// like linux: with the high half unused, the low half is an old style 16 bit dev_t
+					if high == 0 && low&^0xff != 0 {
+						rec.devMajor, rec.devMinor = low>>8, low&0xff
+					} else {
+						rec.devMajor, rec.devMinor = high, low
+					}
+				}
+			case "NM": // alternate name, may be split over multiple entries
+				if len(data) >= 1 && data[0]&(1<<1|1<<2) == 0 {
+					name.Write(data[1:])
+					hasName = true
+				}
+			case "SL": // symlink target, split into components
+				if len(data) < 1 {
+					continue
+				}
+				hasLink = true
+				comps := data[1:]
+				for len(comps) >= 2 {
+					cflags := comps[0]
+					clen := int(comps[1])
+					if 2+clen > len(comps) {
+						break
+					}
+					var part string
+					switch {
+					case cflags&(1<<1) != 0:
+						part = "."
+					case cflags&(1<<2) != 0:
+						part = ".."
+					case cflags&(1<<3) != 0:
+						part = "" // root, results in a leading /
+					default:
+						part = string(comps[2 : 2+clen])
+					}
+					if linkContinues && len(linkParts) > 0 {
+						linkParts[len(linkParts)-1] += part
+					} else {
+						linkParts = append(linkParts, part)
+					}
+					linkContinues = cflags&1 != 0
+					comps = comps[2+clen:]
+				}
+			case "TF": // timestamps
+				if len(data) < 1 {
+					continue
+				}
+				tflags := data[0]
+				size := 7
+				if tflags&(1<<7) != 0 {
+					size = 17
+				}
+				stamps := data[1:]
+				// creation comes before modification, if present
+				if tflags&1 != 0 {
+					if len(stamps) < size {
+						continue
+					}
+					stamps = stamps[size:]
+				}
+				if tflags&(1<<1) != 0 && len(stamps) >= size {
+					if size == 7 {
+						rec.modTime = parseShortTime(stamps[:7])
+					} else {
+						rec.modTime = parseLongTime(stamps[:17])
+					}
+				}
+			case "CL":
+				if len(data) >= 4 {
+					rec.childLink = binary.LittleEndian.Uint32(data[0:4])
+				}
+			case "RE":
+				rec.relocated = true
+			}
+		}
+
+		if ce == nil {
+			break
+		}
+		if continuations >= maxContinuations {
+			return errors.New("too many Rock Ridge continuation areas")
+		}
+		location := int64(binary.LittleEndian.Uint32(ce[0:4]))
+		offset := int64(binary.LittleEndian.Uint32(ce[8:12]))
+		length := int64(binary.LittleEndian.Uint32(ce[16:20]))
+		if length > sectorSize {
+			return fmt.Errorf("Rock Ridge continuation area of %d bytes is too large", length)
+		}
+		susp = make([]byte, length)
+		if _, err := s.reader.ReadAt(susp, location*s.blockSize+offset); err != nil {
+			return fmt.Errorf("reading Rock Ridge continuation area: %w", err)
+		}
+	}
+
+	if hasName {
+		rec.name = name.String()
+	} else {
+		rec.name = plainName(rec.name, rec.dir)
+	}
+	if hasLink {
+		rec.symlink = strings.Join(linkParts, "/")
+		if rec.symlink == "" {
+			rec.symlink = "/"
+		}
+		rec.size = int64(len(rec.symlink))
+		rec.mode = fs.ModeSymlink | rec.mode.Perm()
+	}
+	return nil
+}
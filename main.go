@@ -1,20 +1,35 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lawl/ayy/appimage"
+	"github.com/lawl/ayy/audit"
 	"github.com/lawl/ayy/bytesz"
 	"github.com/lawl/ayy/fancy"
 	"github.com/lawl/ayy/integrate"
+	"github.com/lawl/ayy/iso9660"
+	"github.com/lawl/ayy/policy"
+	"github.com/lawl/ayy/sigstore"
 	"github.com/lawl/ayy/squashfs"
+	"github.com/lawl/ayy/trust"
 	"github.com/lawl/ayy/update"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/term"
 )
 
 var WARNING string
@@ -44,6 +59,15 @@ func main() {
 				"  show               Show details of an AppImage\n"+
 				"  fs                 Interact with an AppImage's internal filesystem\n"+
 				"  inspect            Inspect an AppImage file. Development command. Dumps assorted information.\n"+
+				"  build              Create an AppImage from an AppDir\n"+
+				"  repack             Replace or delete files inside an AppImage\n"+
+				"  sign               Sign an AppImage with an OpenPGP or minisign key\n"+
+				"  set-update-info    Embed or change an AppImage's update information\n"+
+				"  doctor             Check if this machine can run an AppImage\n"+
+				"  trust              Manage the keys trusted to sign AppImages\n"+
+				"  policy             Check AppImages against the install policy\n"+
+				"  verify             Check installed AppImages weren't modified since installing them\n"+
+				"  audit              Scan an AppImage for suspicious files and .desktop entries\n"+
 				"  help               Display this help\n"+
 				"\n"+
 				"Call these commands without any arguments for per command help.\n"+
@@ -76,23 +100,43 @@ func main() {
 		fp.Color(fancy.Yellow)
 		for _, arg := range inspect.Args() {
 			ai := ai(arg)
-			updInfo, err := ai.ELFSectionAsString(".upd_info")
-			if err != nil {
-				fmt.Fprintf(os.Stderr, ERROR+"reading update info: %s\n", err)
-			}
-			sha256sig, err := ai.ELFSectionAsString(".sha256_sig")
-			if err != nil {
-				fmt.Fprintf(os.Stderr, ERROR+"reading update info: %s\n", err)
-			}
-			sigKey, err := ai.ELFSectionAsString(".sig_key")
+			updInfo, err := ai.UpdateInfo()
 			if err != nil {
 				fmt.Fprintf(os.Stderr, ERROR+"reading update info: %s\n", err)
 			}
 			fmt.Printf("%s: %d\n", fp.Format("Image Format Type"), ai.ImageFormatType)
+			switch fsys := ai.FS.(type) {
+			case *squashfs.SquashFS:
+				sb := fsys.Superblock()
+				fmt.Printf("%s: squashfs %d.%d, %s, %s blocks, %d inodes, %s\n", fp.Format("Payload"),
+					sb.VersionMajor, sb.VersionMinor, sb.CompressionName(), strings.TrimSpace(bytesz.Format(uint64(sb.BlockSize))), sb.InodeCount, strings.TrimSpace(bytesz.Format(sb.BytesUsed)))
+				offset := fmt.Sprintf("%d", ai.PayloadOffset())
+				if ai.PayloadOffset() != ai.ELFSize() {
+					offset += fmt.Sprintf(" (found by scanning, the runtime ELF ends at %d)", ai.ELFSize())
+				}
+				fmt.Printf("%s: %s\n", fp.Format("Payload Offset"), offset)
+			case *iso9660.FS:
+				rr := "without Rock Ridge"
+				if fsys.RockRidge() {
+					rr = "Rock Ridge"
+				}
+				fmt.Printf("%s: ISO 9660, %s, volume '%s'\n", fp.Format("Payload"), rr, fsys.VolumeID())
+			}
 			fmt.Printf("%s: %s\n", fp.Format("Update"), updInfo)
 
-			fmt.Printf("%s:\n%s\n", fp.Format("Raw Signature"), string(sha256sig))
-			fmt.Printf("%s:\n%s\n", fp.Format("Raw Signature Key"), string(sigKey))
+			// type 1 has no signatures
+			if ai.ImageFormatType == 2 {
+				sha256sig, err := ai.ELFSectionAsString(".sha256_sig")
+				if err != nil {
+					fmt.Fprintf(os.Stderr, ERROR+"reading signature: %s\n", err)
+				}
+				sigKey, err := ai.ELFSectionAsString(".sig_key")
+				if err != nil {
+					fmt.Fprintf(os.Stderr, ERROR+"reading signature key: %s\n", err)
+				}
+				fmt.Printf("%s:\n%s\n", fp.Format("Raw Signature"), string(sha256sig))
+				fmt.Printf("%s:\n%s\n", fp.Format("Raw Signature Key"), string(sigKey))
+			}
 			printAppImageDetails(arg)
 		}
 
@@ -106,6 +150,9 @@ func main() {
 					"commands:\n"+
 					"  ls <path>          List files under the specified path inside the AppImage\n"+
 					"  cat <path>         Print the file at <path> inside the AppImage to stdout\n"+
+					"  fsck               Check the integrity of the AppImage's filesystem\n"+
+					"  info               Show filesystem details and size statistics\n"+
+					"  serve              Serve the AppImage's filesystem over local HTTP\n"+
 					"\n")
 			fs.PrintDefaults()
 		}
@@ -137,7 +184,7 @@ func main() {
 
 			for _, arg := range ls.Args() {
 				fmt.Printf("%s:\n", arg)
-				listFiles(file, ls.Arg(0), *usebytes)
+				listFiles(file, arg, *usebytes)
 			}
 			os.Exit(0)
 		case "cat":
@@ -160,11 +207,399 @@ func main() {
 				catFile(file, arg)
 			}
 			os.Exit(0)
+		case "fsck":
+			fsck := flag.NewFlagSet("fsck", flag.ExitOnError)
+			fsck.Usage = func() {
+				fmt.Fprintf(os.Stderr,
+					"usage: ayy fs /foo/bar.AppImage fsck\n"+
+						"\n"+
+						"Reads and decompresses everything in the AppImage's filesystem and reports any inconsistencies.\n"+
+						"Useful to diagnose truncated or corrupted downloads.\n"+
+						"\n")
+				fsck.PrintDefaults()
+			}
+			if err := fsck.Parse(fs.Args()[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"Unable to parse flags: %s\n", err)
+				os.Exit(1)
+			}
+			if !fsckImage(file) {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case "info":
+			info := flag.NewFlagSet("info", flag.ExitOnError)
+			info.Usage = func() {
+				fmt.Fprintf(os.Stderr,
+					"usage: ayy fs /foo/bar.AppImage info\n"+
+						"\n")
+				info.PrintDefaults()
+			}
+			usebytes := info.Bool("b", false, "Display sizes in bytes instead of human readable string")
+			nLargest := info.Int("n", 10, "Number of largest files and directories to show")
+			depth := info.Int("depth", 1, "Show directories up to this depth in the directory breakdown")
+			if err := info.Parse(fs.Args()[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"Unable to parse flags: %s\n", err)
+				os.Exit(1)
+			}
+			printFSInfo(file, *nLargest, *depth, *usebytes)
+			os.Exit(0)
+		case "serve":
+			serve := flag.NewFlagSet("serve", flag.ExitOnError)
+			serve.Usage = func() {
+				fmt.Fprintf(os.Stderr,
+					"usage: ayy fs /foo/bar.AppImage serve [-addr 127.0.0.1:8080]\n"+
+						"\n"+
+						"Serves the files inside the AppImage over HTTP, e.g. to view bundled documentation in a browser.\n"+
+						"\n")
+				serve.PrintDefaults()
+			}
+			addr := serve.String("addr", "127.0.0.1:8080", "Address to listen on")
+			if err := serve.Parse(fs.Args()[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"Unable to parse flags: %s\n", err)
+				os.Exit(1)
+			}
+			serveFS(file, *addr)
+			os.Exit(0)
 		default:
 			fs.Usage()
 			os.Exit(1)
 		}
 
+	case "build":
+		build := flag.NewFlagSet("build", flag.ExitOnError)
+		build.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: ayy build ./MyApp.AppDir -runtime runtime-x86_64 -o MyApp.AppImage\n"+
+				"\n"+
+				"The runtime can be downloaded from https://github.com/AppImage/type2-runtime/releases\n"+
+				"Set SOURCE_DATE_EPOCH for all files in the image to get that modification time.\n"+
+				"\n")
+			build.PrintDefaults()
+		}
+		out := build.String("o", "", "Output file, defaults to the AppDir's name with .AppImage")
+		runtimePath := build.String("runtime", "", "AppImage runtime ELF to use (required)")
+		updInfo := build.String("update-info", "", "Update information to embed, e.g. 'gh-releases-zsync|user|repo|latest|Foo-*x86_64.AppImage.zsync'")
+		signKey := build.String("sign", "", "Sign the AppImage with the OpenPGP private key in this file")
+		comp := build.String("comp", "gzip", "Compression to use, gzip or zstd. Older runtimes only support gzip")
+		build.Parse(flag.Args()[1:])
+
+		if build.NArg() < 1 {
+			build.Usage()
+			os.Exit(1)
+		}
+		appDir := build.Arg(0)
+		// allow flags after the AppDir too
+		build.Parse(build.Args()[1:])
+		if build.NArg() > 0 {
+			build.Usage()
+			os.Exit(1)
+		}
+		if *runtimePath == "" {
+			fmt.Fprintf(os.Stderr, ERROR+"-runtime is required\n")
+			os.Exit(1)
+		}
+		if *out == "" {
+			*out = strings.TrimSuffix(filepath.Base(filepath.Clean(appDir)), ".AppDir") + ".AppImage"
+		}
+
+		opts := appimage.BuildOptions{
+			Runtime:    *runtimePath,
+			UpdateInfo: *updInfo,
+		}
+		opts.FS.AllRoot = true
+		switch *comp {
+		case "gzip":
+			opts.FS.Compression = squashfs.CompressionGzip
+		case "zstd":
+			opts.FS.Compression = squashfs.CompressionZstd
+		default:
+			fmt.Fprintf(os.Stderr, ERROR+"unknown compression '%s'\n", *comp)
+			os.Exit(1)
+		}
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			sec, err := strconv.ParseInt(epoch, 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"invalid SOURCE_DATE_EPOCH: %s\n", err)
+				os.Exit(1)
+			}
+			opts.FS.ModTime = time.Unix(sec, 0)
+		}
+		if *signKey != "" {
+			opts.SignKey = readSigningKey(*signKey)
+		}
+
+		warnings, err := appimage.ValidateAppDir(appDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, ERROR+"Invalid AppDir: %s\n", err)
+			os.Exit(1)
+		}
+		for _, w := range warnings {
+			fmt.Fprintf(os.Stderr, WARNING+"%s\n", w)
+		}
+
+		if err := appimage.Build(*out, appDir, opts); err != nil {
+			fmt.Fprintf(os.Stderr, ERROR+"Unable to build AppImage: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf(INFO+"Created %s\n", *out)
+		os.Exit(0)
+	case "repack":
+		repack := flag.NewFlagSet("repack", flag.ExitOnError)
+		repack.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: ayy repack /foo/bar.AppImage -replace internal/path=local/file -delete internal/path\n"+
+				"\n"+
+				"Rewrites the AppImage's filesystem with the given files replaced, added or deleted.\n"+
+				"The runtime is kept as is. Any signature becomes invalid, and is removed unless -sign is given.\n"+
+				"\n")
+			repack.PrintDefaults()
+		}
+		var replace, remove multiFlag
+		repack.Var(&replace, "replace", "Put local file at path inside the AppImage, as path=local. Can be given multiple times")
+		repack.Var(&remove, "delete", "Delete path inside the AppImage. Can be given multiple times")
+		out := repack.String("o", "", "Write the result here instead of modifying the AppImage in place")
+		signKey := repack.String("sign", "", "Re-sign the AppImage with the OpenPGP private key in this file")
+		repack.Parse(flag.Args()[1:])
+
+		if repack.NArg() < 1 {
+			repack.Usage()
+			os.Exit(1)
+		}
+		aiPath := repack.Arg(0)
+		// allow flags after the AppImage too
+		repack.Parse(repack.Args()[1:])
+		if repack.NArg() > 0 || (len(replace) == 0 && len(remove) == 0) {
+			repack.Usage()
+			os.Exit(1)
+		}
+		if *out == "" {
+			*out = aiPath
+		}
+
+		opts := appimage.RepackOptions{Replace: make(map[string]string), Delete: remove}
+		for _, r := range replace {
+			spl := strings.SplitN(r, "=", 2)
+			if len(spl) != 2 || spl[0] == "" || spl[1] == "" {
+				fmt.Fprintf(os.Stderr, ERROR+"-replace expects path=local, got '%s'\n", r)
+				os.Exit(1)
+			}
+			opts.Replace[spl[0]] = spl[1]
+		}
+		if *signKey != "" {
+			opts.SignKey = readSigningKey(*signKey)
+		}
+
+		ai := ai(aiPath)
+		defer ai.Close()
+		if err := ai.Repack(*out, opts); err != nil {
+			fmt.Fprintf(os.Stderr, ERROR+"Unable to repack AppImage: %s\n", err)
+			os.Exit(1)
+		}
+		if opts.SignKey == nil && ai.HasSignature() {
+			fmt.Fprintf(os.Stderr, WARNING+"The AppImage was signed. The signature doesn't match the new contents and has been removed. Use -sign to sign it again.\n")
+		}
+		if ai.HasMinisign() {
+			fmt.Fprintf(os.Stderr, WARNING+"The AppImage had a minisign signature. It doesn't match the new contents and has been removed. Use 'ayy sign -minisign' to sign it again.\n")
+		}
+		fmt.Printf(INFO+"Repacked %s\n", *out)
+		os.Exit(0)
+	case "sign":
+		sign := flag.NewFlagSet("sign", flag.ExitOnError)
+		sign.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: ayy sign -key private.asc /foo/bar.AppImage\n"+
+				"       ayy sign -minisign minisign.key /foo/bar.AppImage\n"+
+				"\n"+
+				"Signs the AppImage in place, replacing any existing signature.\n"+
+				"If the key is passphrase protected, the passphrase is read from "+signPassphraseEnv+"\n"+
+				"or asked for on the terminal.\n"+
+				"\n"+
+				"Both kinds of signatures can be combined. minisign signatures need a runtime with\n"+
+				".minisig and .minisig_key sections, alternatively sign the file with minisign -S\n"+
+				"and ship the .minisig next to it.\n"+
+				"\n")
+			sign.PrintDefaults()
+		}
+		keyPath := sign.String("key", "", "OpenPGP private key to sign with, armored or binary")
+		minisignPath := sign.String("minisign", "", "minisign secret key to sign with")
+		sign.Parse(flag.Args()[1:])
+
+		if sign.NArg() < 1 {
+			sign.Usage()
+			os.Exit(1)
+		}
+		aiPath := sign.Arg(0)
+		// allow flags after the AppImage too
+		sign.Parse(sign.Args()[1:])
+		if sign.NArg() > 0 || (*keyPath == "" && *minisignPath == "") {
+			sign.Usage()
+			os.Exit(1)
+		}
+
+		ai, err := appimage.OpenForWriting(aiPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, ERROR+"Couldn't open AppImage: %s\n", err)
+			os.Exit(1)
+		}
+		defer ai.Close()
+
+		// the OpenPGP signature covers the minisign one, so minisign goes first
+		if *minisignPath != "" {
+			mkey := readMinisignKey(*minisignPath)
+			comment := fmt.Sprintf("timestamp:%d\tfile:%s", time.Now().Unix(), filepath.Base(aiPath))
+			if err := ai.SignMinisign(mkey, comment); err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"Unable to sign AppImage: %s\n", err)
+				os.Exit(1)
+			}
+			if _, ok, err := ai.Minisign(); !ok {
+				fmt.Fprintf(os.Stderr, ERROR+"Signed, but the minisign signature doesn't verify: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf(INFO+"Signed %s with minisign key %s\n", aiPath, mkey.IDString())
+			if *keyPath == "" && ai.HasSignature() {
+				fmt.Fprintf(os.Stderr, WARNING+"The AppImage's OpenPGP signature doesn't match anymore, sign with -key too.\n")
+			}
+		}
+		if *keyPath == "" {
+			os.Exit(0)
+		}
+
+		key := readSigningKey(*keyPath)
+		if err := ai.Sign(key); err != nil {
+			fmt.Fprintf(os.Stderr, ERROR+"Unable to sign AppImage: %s\n", err)
+			os.Exit(1)
+		}
+		// check it's actually accepted by what we verify with
+		signer, ok, err := ai.Signature()
+		if !ok {
+			fmt.Fprintf(os.Stderr, ERROR+"Signed, but the signature doesn't verify: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf(INFO+"Signed %s with key %X\n", aiPath, signer.PrimaryKey.KeyId)
+		for name := range signer.Identities {
+			fmt.Printf("      Identity: %s\n", name)
+		}
+		os.Exit(0)
+	case "set-update-info":
+		setupd := flag.NewFlagSet("set-update-info", flag.ExitOnError)
+		setupd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: ayy set-update-info /foo/bar.AppImage '<update information>'\n"+
+				"\n"+
+				"Supported formats:\n"+
+				"  zsync|https://example.com/Foo-latest-x86_64.AppImage.zsync\n"+
+				"  gh-releases-zsync|user|repo|latest|Foo-*x86_64.AppImage.zsync\n"+
+				"\n")
+			setupd.PrintDefaults()
+		}
+		force := setupd.Bool("force", false, "Write the update information even if ayy can't update from it")
+		setupd.Parse(flag.Args()[1:])
+
+		if setupd.NArg() < 2 {
+			setupd.Usage()
+			os.Exit(1)
+		}
+		aiPath, updInfo := setupd.Arg(0), setupd.Arg(1)
+		// allow flags after the arguments too
+		setupd.Parse(setupd.Args()[2:])
+		if setupd.NArg() > 0 {
+			setupd.Usage()
+			os.Exit(1)
+		}
+
+		if err := update.ValidateUpdateInfo(updInfo); err != nil {
+			if !*force {
+				fmt.Fprintf(os.Stderr, ERROR+"Invalid update information: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, WARNING+"ayy won't be able to update from this: %s\n", err)
+		}
+
+		ai, err := appimage.OpenForWriting(aiPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, ERROR+"Couldn't open AppImage: %s\n", err)
+			os.Exit(1)
+		}
+		defer ai.Close()
+
+		oldInfo, _ := ai.UpdateInfo()
+		oldID := ai.ID()
+		signed := ai.HasSignature() || ai.HasMinisign()
+
+		if err := ai.SetUpdateInfo(updInfo); err != nil {
+			fmt.Fprintf(os.Stderr, ERROR+"Unable to write update information: %s\n", err)
+			os.Exit(1)
+		}
+		if err := ai.UpdateDigest(); err != nil {
+			fmt.Fprintf(os.Stderr, ERROR+"Unable to update digest: %s\n", err)
+			os.Exit(1)
+		}
+		newID := ai.ID()
+
+		fp := fancy.Print{}
+		fp.Color(fancy.Yellow)
+		if oldInfo == "" {
+			oldInfo = "<none>"
+		}
+		fmt.Printf("%s: %s => %s\n", fp.Format("Update"), oldInfo, updInfo)
+		if oldID == newID {
+			fmt.Printf("%s: %s (unchanged)\n", fp.Format("ID"), newID)
+		} else {
+			fmt.Printf("%s: %s => %s\n", fp.Format("ID"), oldID, newID)
+			fmt.Fprintf(os.Stderr, WARNING+"The ID changed. If this AppImage is installed, reinstall it, otherwise it won't be recognized as the same application.\n")
+		}
+		if signed {
+			fmt.Fprintf(os.Stderr, WARNING+"The AppImage's signature doesn't match anymore. Sign it again with 'ayy sign'.\n")
+		}
+		os.Exit(0)
+	case "doctor":
+		doctor := flag.NewFlagSet("doctor", flag.ExitOnError)
+		doctor.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: ayy doctor /foo/bar.AppImage\n"+
+				"\n"+
+				"Checks that this machine has what the AppImage's runtime needs to start,\n"+
+				"e.g. libfuse2 for older AppImages.\n"+
+				"\n")
+			doctor.PrintDefaults()
+		}
+		doctor.Parse(flag.Args()[1:])
+
+		if doctor.NArg() < 1 {
+			doctor.Usage()
+			os.Exit(1)
+		}
+
+		fp := fancy.Print{}
+		fp.Color(fancy.Yellow)
+		exitCode := 0
+		for _, arg := range doctor.Args() {
+			ai := ai(arg)
+			d, err := ai.Diagnose()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"Couldn't inspect runtime of '%s': %s\n", arg, err)
+				os.Exit(1)
+			}
+
+			rt := d.Runtime
+			kind := "static"
+			if !rt.Static() {
+				kind = "dynamic, needs " + strings.Join(rt.Needed, ", ")
+			}
+			fmt.Printf("%s: %s\n", fp.Format("AppImage"), arg)
+			fmt.Printf("%s: %s (%d bit), %s\n", fp.Format("Runtime"), rt.Arch, rt.Bits, kind)
+			if rt.Interpreter != "" {
+				fmt.Printf("%s: %s\n", fp.Format("Interpreter"), rt.Interpreter)
+			}
+
+			for _, w := range d.Warnings {
+				fmt.Fprintf(os.Stderr, WARNING+"%s\n", w)
+			}
+			for _, p := range d.Problems {
+				fmt.Fprintf(os.Stderr, ERROR+"%s\n", p)
+			}
+			if len(d.Problems) > 0 {
+				exitCode = 1
+			} else if len(d.Warnings) == 0 {
+				fmt.Println(INFO + "No problems found.")
+			}
+		}
+		os.Exit(exitCode)
 	case "lmao":
 		fmt.Println("ayy lmao")
 		os.Exit(0)
@@ -177,6 +612,8 @@ func main() {
 				"\n")
 			install.PrintDefaults()
 		}
+		force := install.Bool("force", false, "Install even if the AppImage was built for a different architecture")
+		auditLevel := install.String("audit", "", "Refuse AppImages the audit finds something at least this severe in: high, medium or low")
 		install.Parse(flag.Args()[1:])
 
 		if install.NArg() < 1 {
@@ -184,10 +621,24 @@ func main() {
 			os.Exit(1)
 		}
 
+		sev := parseAuditLevel(*auditLevel)
 		for _, arg := range install.Args() {
-			_, err := integrate.Install(arg, "")
+			opts := integrate.Options{
+				Force: *force,
+				Audit: sev,
+				KeyRotated: func(id appimage.AppImageID, r trust.Rotation) {
+					fmt.Printf(INFO+"%s: %s\n", id, r)
+				},
+			}
+			_, err := integrate.Install(arg, "", opts)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, ERROR+"Cannot install AppImage: %s\n", err)
+				if errors.Is(err, appimage.ErrWrongArch) {
+					fmt.Fprintf(os.Stderr, INFO+"Use -force to install it anyway.\n")
+				}
+				if errors.Is(err, audit.ErrFindings) {
+					fmt.Fprintf(os.Stderr, INFO+"See 'ayy audit %s' for details.\n", arg)
+				}
 				os.Exit(1)
 			}
 		}
@@ -220,12 +671,25 @@ func main() {
 				fmt.Fprintf(os.Stderr, ERROR+"Unable delete AppImage file '%s': %s\n", path, err)
 				os.Exit(1)
 			}
+			if err := integrate.ForgetRecord(path); err != nil {
+				fmt.Fprintf(os.Stderr, WARNING+"Unable to forget the install record of '%s': %s\n", path, err)
+			}
 		}
 		os.Exit(0)
 	case "upgrade":
+		upgrade := flag.NewFlagSet("upgrade", flag.ExitOnError)
+		upgrade.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: ayy upgrade\n"+
+				"\n")
+			upgrade.PrintDefaults()
+		}
+		force := upgrade.Bool("force", false, "Install updates even if they were built for a different architecture")
+		auditLevel := upgrade.String("audit", "", "Refuse updates the audit finds something at least this severe in: high, medium or low")
+		upgrade.Parse(flag.Args()[1:])
+
 		// TODO: support arguments, so that e.g. "ayy upgrade foo bar" only updates foo and bar
 		appList, _ := integrate.List()
-		parallelUpgrade(appList)
+		parallelUpgrade(appList, integrate.Options{Force: *force, Audit: parseAuditLevel(*auditLevel)})
 		os.Exit(0)
 	case "show":
 		show := flag.NewFlagSet("show", flag.ExitOnError)
@@ -311,6 +775,438 @@ func main() {
 
 		//printaliases()
 		os.Exit(0)
+	case "trust":
+		trustCmd := flag.NewFlagSet("trust", flag.ExitOnError)
+		trustCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr,
+				"usage: ayy trust command\n"+
+					"\n"+
+					"The first key seen signing an AppImage is trusted for its ID from then on,\n"+
+					"images signed by another key are refused, even after the old one is removed.\n"+
+					"Vendors can change keys by certifying the new key with the old one, shipped\n"+
+					"in the AppImage's .sig_key or in a file next to it, named like the AppImage\n"+
+					"with "+trust.RotationSuffix+" appended.\n"+
+					"\n"+
+					"commands:\n"+
+					"  list                      List IDs and the keys trusted for them\n"+
+					"  show <id>                 Show the key trusted for an ID\n"+
+					"  forget <id>               Forget the key trusted for an ID, the next one seen is trusted\n"+
+					"  pin /foo/bar.AppImage     Trust the key that signed this AppImage for its ID\n"+
+					"  pin <id> <fingerprint>    Trust the OpenPGP key with this fingerprint for an ID\n"+
+					"  pin <id> <public key>     Trust this minisign public key for an ID, e.g. RWQf6LRCGA9i53ml...\n"+
+					"  import <file.asc>...      Import OpenPGP public keys you trust, armored or binary\n"+
+					"  import -gnupg [key ID]... Import keys from your GnuPG keyring, all fully valid ones by default\n"+
+					"\n"+
+					"Imported keys verify signatures even if the AppImage doesn't embed them, and AppImages\n"+
+					"signed by them show as trusted. Which key may sign an ID is still decided as above.\n"+
+					"\n"+
+					"Sigstore bundles next to the AppImage, named like it with "+sigstore.BundleSuffix+" appended,\n"+
+					"are verified offline against the trusted root at %s.\n"+
+					"Their signer is the certificate's identity and issuer.\n"+
+					"\n"+
+					"The trust store is at %s, imported keys are in %s\n"+
+					"\n", sigstore.RootPath(), trust.Path(), trust.KeyringPath())
+			trustCmd.PrintDefaults()
+		}
+		trustCmd.Parse(flag.Args()[1:])
+
+		fp := fancy.Print{}
+		fp.Color(fancy.Yellow)
+		switch trustCmd.Arg(0) {
+		case "list":
+			store, err := trust.Load()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+				os.Exit(1)
+			}
+			cyan := fancy.Print{}
+			cyan.Color(fancy.Cyan)
+			normal := fancy.Print{}
+			tbl := newTable(40, 18, 9, -1).withFormatters(cyan, normal, normal, normal)
+			tbl.printHead("ID", "Key ID", "Scheme", "Identity")
+			keyring, err := trust.LoadKeyring()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+				os.Exit(1)
+			}
+			for _, e := range store.List() {
+				identity := strings.Join(e.Identities, ", ")
+				if e.Pinned {
+					identity = strings.TrimSpace(identity + " (pinned)")
+				}
+				tbl.printRow(string(e.ID), e.KeyID, e.SchemeName(), identity)
+			}
+			if len(keyring) > 0 {
+				fmt.Println()
+				keys := newTable(42, -1).withFormatters(cyan, normal)
+				keys.printHead("Imported key", "Identity")
+				for _, e := range keyring {
+					k := trust.KeyFromEntity(e)
+					keys.printRow(k.Fingerprint, strings.Join(k.Identities, ", "))
+				}
+			}
+		case "show":
+			if trustCmd.NArg() != 2 {
+				trustCmd.Usage()
+				os.Exit(1)
+			}
+			store, err := trust.Load()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+				os.Exit(1)
+			}
+			id := appimage.AppImageID(trustCmd.Arg(1))
+			key := store.Get(id)
+			if key == nil {
+				fmt.Fprintf(os.Stderr, ERROR+"No key is trusted for '%s'\n", id)
+				os.Exit(1)
+			}
+			fmt.Printf("%s: %s\n", fp.Format("ID"), id)
+			fmt.Printf("%s: %s\n", fp.Format("Scheme"), key.SchemeName())
+			fmt.Printf("%s: %s\n", fp.Format("Fingerprint"), key.Fingerprint)
+			if key.KeyID != "" {
+				fmt.Printf("%s: %s\n", fp.Format("Key ID"), key.KeyID)
+			}
+			for _, i := range key.Identities {
+				fmt.Printf("%s: %s\n", fp.Format("Identity"), i)
+			}
+			if key.Issuer != "" {
+				fmt.Printf("%s: %s\n", fp.Format("Issuer"), key.Issuer)
+			}
+			how := "trust on first use"
+			if key.Pinned {
+				how = "pinned"
+			}
+			if imported, _ := trust.IsImported(key.Fingerprint); imported {
+				how += ", imported key"
+			}
+			fmt.Printf("%s: %s (%s)\n", fp.Format("Since"), key.FirstSeen.Local().Format(time.RFC1123), how)
+			for _, r := range key.Rotations {
+				fmt.Printf("%s: %s, from %s to %s (proof: %s)\n", fp.Format("Rotated"), r.At.Local().Format(time.RFC1123), r.From, r.To, r.Proof)
+			}
+		case "forget":
+			if trustCmd.NArg() != 2 {
+				trustCmd.Usage()
+				os.Exit(1)
+			}
+			id := appimage.AppImageID(trustCmd.Arg(1))
+			err := trust.Update(func(store *trust.Store) error {
+				if !store.Forget(id) {
+					return fmt.Errorf("No key is trusted for '%s'", id)
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf(INFO+"Forgot the key for '%s', the next key seen signing it will be trusted.\n", id)
+		case "pin":
+			var id appimage.AppImageID
+			var key *trust.Key
+			switch trustCmd.NArg() {
+			case 2:
+				ai := ai(trustCmd.Arg(1))
+				k, err := trust.FileSigner(ai, trustCmd.Arg(1))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+					os.Exit(1)
+				}
+				if k == nil {
+					fmt.Fprintf(os.Stderr, ERROR+"'%s' is not signed\n", trustCmd.Arg(1))
+					os.Exit(1)
+				}
+				id, key = ai.ID(), k
+				ai.Close()
+			case 3:
+				id = appimage.AppImageID(trustCmd.Arg(1))
+				if mk, err := appimage.ParseMinisignKey(trustCmd.Arg(2)); err == nil {
+					key = trust.KeyFromMinisign(mk)
+					break
+				}
+				fingerprint := strings.ToUpper(strings.ReplaceAll(trustCmd.Arg(2), " ", ""))
+				if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 40 {
+					fmt.Fprintf(os.Stderr, ERROR+"'%s' is neither an OpenPGP fingerprint of 40 hex digits, nor a minisign public key\n", trustCmd.Arg(2))
+					os.Exit(1)
+				}
+				key = &trust.Key{Scheme: trust.SchemeOpenPGP, Fingerprint: fingerprint, KeyID: fingerprint[24:], FirstSeen: time.Now().UTC()}
+			default:
+				trustCmd.Usage()
+				os.Exit(1)
+			}
+			var old *trust.Key
+			err := trust.Update(func(store *trust.Store) error {
+				old = store.Get(id)
+				store.Pin(id, key)
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+				os.Exit(1)
+			}
+			if old != nil && old.Fingerprint != key.Fingerprint {
+				fmt.Fprintf(os.Stderr, WARNING+"'%s' was trusted with key %s before, this is replaced now.\n", id, old.Fingerprint)
+			}
+			fmt.Printf(INFO+"Pinned key %s for '%s'\n", key.Fingerprint, id)
+		case "import":
+			importCmd := flag.NewFlagSet("trust import", flag.ExitOnError)
+			gnupg := importCmd.Bool("gnupg", false, "import from your GnuPG keyring, the keys it considers fully valid, or the given key IDs")
+			importCmd.Usage = trustCmd.Usage
+			importCmd.Parse(trustCmd.Args()[1:])
+			if importCmd.NArg() == 0 && !*gnupg {
+				trustCmd.Usage()
+				os.Exit(1)
+			}
+
+			var keys openpgp.EntityList
+			if *gnupg {
+				k, err := trust.ReadGnuPG(importCmd.Args())
+				if err != nil {
+					fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+					os.Exit(1)
+				}
+				keys = k
+			} else {
+				for _, arg := range importCmd.Args() {
+					k, err := trust.ReadKeys(arg)
+					if err == nil && k == nil {
+						err = fs.ErrNotExist
+					}
+					if err != nil {
+						fmt.Fprintf(os.Stderr, ERROR+"'%s': %s\n", arg, err)
+						os.Exit(1)
+					}
+					keys = append(keys, k...)
+				}
+			}
+			if len(keys) == 0 && *gnupg && importCmd.NArg() == 0 {
+				fmt.Fprintf(os.Stderr, ERROR+"GnuPG doesn't consider any key fully valid, name the key IDs to import them anyway\n")
+				os.Exit(1)
+			}
+			if len(keys) == 0 {
+				fmt.Fprintf(os.Stderr, ERROR+"No keys found to import\n")
+				os.Exit(1)
+			}
+			added, err := trust.Import(keys)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+				os.Exit(1)
+			}
+			for _, k := range added {
+				fmt.Printf(INFO+"Imported key %s %s\n", k.Fingerprint, strings.Join(k.Identities, ", "))
+			}
+			if refreshed := len(keys) - len(added); refreshed > 0 {
+				fmt.Printf(INFO+"Refreshed %d key(s) that were imported before\n", refreshed)
+			}
+		default:
+			trustCmd.Usage()
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "policy":
+		policyCmd := flag.NewFlagSet("policy", flag.ExitOnError)
+		policyCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr,
+				"usage: ayy policy check /foo/bar.AppImage\n"+
+					"\n"+
+					"Checks whether the policy allows installing, upgrading and aliasing the AppImage, without doing any of it.\n"+
+					"\n"+
+					"The policy is read from %s, e.g.\n"+
+					"\n"+
+					"  {\n"+
+					"    \"require_signature\": true,\n"+
+					"    \"signature_exceptions\": [\"ayy_gh-someone-tool-latest\"],\n"+
+					"    \"allowed_keys\": [\"D992CF59A8DAE6553BDEE870B810DBB22A60AB1E\"],\n"+
+					"    \"allowed_identities\": [{\"issuer\": \"https://token.actions.githubusercontent.com\",\n"+
+					"                            \"subject\": \"https://github.com/someone/tool/*\"}],\n"+
+					"    \"allowed_update_hosts\": [\"github.com\"],\n"+
+					"    \"allowed_ids\": [\"org.example.*\", \"ayy_gh-*\"]\n"+
+					"  }\n"+
+					"\n"+
+					"Rules that are left out don't restrict anything, without the file everything is allowed.\n"+
+					"Signed AppImages must be signed by one of the allowed keys or, through Sigstore, by one of\n"+
+					"the allowed identities, where * matches anything.\n"+
+					"\n", policy.Path())
+			policyCmd.PrintDefaults()
+		}
+		policyCmd.Parse(flag.Args()[1:])
+
+		if policyCmd.Arg(0) != "check" || policyCmd.NArg() < 2 {
+			policyCmd.Usage()
+			os.Exit(1)
+		}
+
+		cyan := fancy.Print{}
+		cyan.Color(fancy.Cyan)
+		exitCode := 0
+		for _, arg := range policyCmd.Args()[1:] {
+			ai := ai(arg)
+			violations, err := policy.Evaluate(ai, arg)
+			ai.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"%s: %s\n", arg, err)
+				exitCode = 1
+				continue
+			}
+			if len(violations) == 0 {
+				fmt.Printf("%s: allowed\n", cyan.Format(arg))
+				continue
+			}
+			exitCode = 1
+			fmt.Printf("%s: blocked\n", cyan.Format(arg))
+			for _, v := range violations {
+				fmt.Printf("\t%s: %s\n", v.Rule, v.Reason)
+			}
+		}
+		os.Exit(exitCode)
+	case "verify":
+		verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+		id := verifyCmd.Bool("id", false, "use id instead of name")
+		jsonOut := verifyCmd.Bool("json", false, "print the report as JSON")
+		verifyCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: ayy verify [name...]\n"+
+				"\n"+
+				"Re-verifies installed AppImages, all of them if no names are given: their signatures,\n"+
+				"embedded digests and the SHA-256 recorded when they were installed.\n"+
+				"Exits with 1 if any check fails.\n"+
+				"\n")
+			verifyCmd.PrintDefaults()
+		}
+		verifyCmd.Parse(flag.Args()[1:])
+
+		// the point is to notice tampering, so don't believe the cache
+		appimage.DisableDigestCache()
+
+		var paths []string
+		if verifyCmd.NArg() == 0 {
+			paths, _ = integrate.List()
+		}
+		for _, arg := range verifyCmd.Args() {
+			paths = append(paths, findAppImagefromCLIArgs(arg, *id))
+		}
+
+		report := struct {
+			OK     bool                      `json:"ok"`
+			Images []*integrate.Verification `json:"images"`
+		}{OK: true, Images: []*integrate.Verification{}}
+		for _, path := range paths {
+			v := integrate.Verify(path)
+			report.Images = append(report.Images, v)
+			report.OK = report.OK && v.OK
+		}
+
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(report)
+		} else {
+			failed := fancy.Print{}
+			failed.Color(fancy.Red).Bold()
+			okColor := fancy.Print{}
+			okColor.Color(fancy.Green)
+			dim := fancy.Print{}
+			dim.Dim()
+			for _, v := range report.Images {
+				name := v.Name
+				if name == "" {
+					name = filepath.Base(v.Path)
+				}
+				status := okColor.Format("ok")
+				if !v.OK {
+					status = failed.Format("FAILED")
+				}
+				fmt.Printf("%s (%s): %s\n", name, v.Path, status)
+				for _, c := range v.Checks {
+					cs := c.Status
+					switch c.Status {
+					case integrate.CheckFailed:
+						cs = failed.Format(c.Status)
+					case integrate.CheckSkipped:
+						cs = dim.Format(c.Status)
+					}
+					fmt.Printf("\t%-10s %s, %s\n", c.Name+":", cs, c.Detail)
+				}
+			}
+			if len(report.Images) == 0 {
+				fmt.Println("No AppImages installed")
+			}
+		}
+		if !report.OK {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "audit":
+		auditCmd := flag.NewFlagSet("audit", flag.ExitOnError)
+		jsonOut := auditCmd.Bool("json", false, "print the findings as JSON")
+		failLevel := auditCmd.String("fail", "high", "exit with 1 if anything at least this severe is found: high, medium or low")
+		auditCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: ayy audit /foo/bar.AppImage\n"+
+				"\n"+
+				"Scans the AppImage's filesystem and .desktop file for things applications have no reason to contain:\n"+
+				"setuid and setgid files, device nodes, world writable files, symlinks pointing out of the image,\n"+
+				"Exec lines that don't run the AppImage and .desktop entries claiming to open e.g. web links or executables.\n"+
+				"\n"+
+				"Nothing in the AppImage is run. A clean audit doesn't mean an AppImage is safe to run.\n"+
+				"'ayy install -audit high' refuses AppImages with high severity findings.\n"+
+				"\n")
+			auditCmd.PrintDefaults()
+		}
+		auditCmd.Parse(flag.Args()[1:])
+
+		if auditCmd.NArg() < 1 {
+			auditCmd.Usage()
+			os.Exit(1)
+		}
+		fail := parseAuditLevel(*failLevel)
+
+		exitCode := 0
+		reports := []*audit.Report{}
+		for _, arg := range auditCmd.Args() {
+			ai := ai(arg)
+			r, err := audit.Audit(ai, arg)
+			ai.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ERROR+"%s: %s\n", arg, err)
+				exitCode = 1
+				continue
+			}
+			if fail != "" && r.Highest().AtLeast(fail) {
+				exitCode = 1
+			}
+			reports = append(reports, r)
+		}
+
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(reports)
+			os.Exit(exitCode)
+		}
+
+		cyan := fancy.Print{}
+		cyan.Color(fancy.Cyan)
+		high := fancy.Print{}
+		high.Color(fancy.Red).Bold()
+		medium := fancy.Print{}
+		medium.Color(fancy.Yellow).Bold()
+		low := fancy.Print{}
+		low.Dim()
+		colors := map[audit.Severity]*fancy.Print{audit.SeverityHigh: &high, audit.SeverityMedium: &medium, audit.SeverityLow: &low}
+		for _, r := range reports {
+			if len(r.Findings) == 0 {
+				fmt.Printf("%s: nothing found\n", cyan.Format(r.Path))
+				continue
+			}
+			plural := "s"
+			if len(r.Findings) == 1 {
+				plural = ""
+			}
+			fmt.Printf("%s: %d finding%s\n", cyan.Format(r.Path), len(r.Findings), plural)
+			for _, f := range r.Findings {
+				fmt.Printf("\t%s %s\n", colors[f.Severity].Format(fmt.Sprintf("%-7s", f.Severity)), f)
+			}
+		}
+		os.Exit(exitCode)
 	case "help", "-h", "--help":
 		flag.Usage()
 		os.Exit(0)
@@ -329,8 +1225,97 @@ func ai(path string) *appimage.AppImage {
 	return app
 }
 
+// for commands that only work on squashfs, i.e. type 2 AppImages
+func squashFSOrExit(ai *appimage.AppImage) *squashfs.SquashFS {
+	sqfs := ai.SquashFS()
+	if sqfs == nil {
+		fmt.Fprintf(os.Stderr, ERROR+"This is a type %d AppImage, this only works for squashfs based type 2 AppImages\n", ai.ImageFormatType)
+		os.Exit(1)
+	}
+	return sqfs
+}
+
+// environment variable to take the passphrase of signing keys from, for CI
+const signPassphraseEnv = "AYY_SIGN_PASSPHRASE"
+
+// readSigningKey reads a private key and decrypts it if needed,
+// with the passphrase from the environment or the terminal
+func readSigningKey(path string) *openpgp.Entity {
+	key, err := appimage.ReadSigningKey(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"Unable to read signing key: %s\n", err)
+		os.Exit(1)
+	}
+	if !key.PrivateKey.Encrypted {
+		return key
+	}
+
+	passphrase := readPassphrase(fmt.Sprintf("%X", key.PrimaryKey.KeyId))
+	if err := appimage.DecryptSigningKey(key, passphrase); err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"Unable to decrypt signing key: %s\n", err)
+		os.Exit(1)
+	}
+	return key
+}
+
+// readMinisignKey reads a minisign secret key, like readSigningKey()
+func readMinisignKey(path string) *appimage.MinisignSecretKey {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"Unable to read minisign key: %s\n", err)
+		os.Exit(1)
+	}
+	var passphrase []byte
+	if appimage.IsEncryptedMinisignSecretKey(string(buf)) {
+		passphrase = readPassphrase(path)
+	}
+	key, err := appimage.ParseMinisignSecretKey(string(buf), passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"Unable to read minisign key: %s\n", err)
+		os.Exit(1)
+	}
+	return key
+}
+
+// readPassphrase reads the passphrase for a signing key from the environment or the terminal
+func readPassphrase(keyName string) []byte {
+	passphrase, fromEnv := os.LookupEnv(signPassphraseEnv)
+	if fromEnv {
+		return []byte(passphrase)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, ERROR+"Signing key is passphrase protected. Set %s or run interactively.\n", signPassphraseEnv)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for key %s: ", keyName)
+	buf, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"Unable to read passphrase: %s\n", err)
+		os.Exit(1)
+	}
+	return buf
+}
+
+// multiFlag collects all values of a flag that is given multiple times
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, ", ")
+}
+
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
+
+// turns a path like /usr/bin/ into one io/fs accepts, i.e. usr/bin. / becomes .
 func unrootPath(s string) string {
-	return strings.TrimLeft(s, string(os.PathSeparator))
+	s = strings.TrimLeft(path.Clean("/"+s), "/")
+	if s == "" {
+		return "."
+	}
+	return s
 }
 
 func listAppimages() {
@@ -418,14 +1403,33 @@ func printAppImageDetails(path string) error {
 		"",
 		cyan.Format(name), yellow.Format(version), installedStr, wrapperstr, updater.InfoString(), path, appstreamid)
 
+	arch := fmt.Sprintf("%s (%d bit)", ai.Arch(), ai.Bits())
+	if ai.CheckArch() != nil {
+		arch = nocolor.Format(arch) + fmt.Sprintf(", this machine is %s", appimage.HostArch())
+	}
+	fmt.Printf("\t     Arch: %s\n", arch)
+
+	// the .digest_md5 section, a checksum over the whole AppImage
+	fmt.Print("\t   Digest: ")
+	if ai.HasDigest() {
+		if _, err := ai.VerifyDigest(); err != nil {
+			fmt.Printf("%s\n", nocolor.Format("mismatch, the AppImage is corrupted"))
+		} else {
+			fmt.Printf("%s (MD5)\n", yes)
+		}
+	} else {
+		fmt.Printf("%s\n", no)
+	}
+
 	fmt.Print("\tSignature: ")
 	if ai.HasSignature() {
-		sig, ok, err := ai.Signature()
+		keyring, _ := trust.LoadKeyring()
+		sig, ok, err := ai.SignatureWithKeyring(keyring)
 		if err == nil {
 			if ok {
 				hasOkSig = true
-				fmt.Printf("%s ", yes)
-				fmt.Printf("[Primary Key ID: %s] (trust on first use)\n", sig.PrimaryKey.KeyIdString())
+				fmt.Printf("%s, OpenPGP ", yes)
+				fmt.Printf("[Primary Key ID: %s] %s\n", sig.PrimaryKey.KeyIdString(), trustString(ai.ID(), trust.KeyFromEntity(&sig), nocolor))
 				idprint := fancy.Print{}
 				idprint.Color(fancy.Yellow)
 				for _, i := range sig.Identities {
@@ -434,6 +1438,35 @@ func printAppImageDetails(path string) error {
 			}
 		}
 	}
+	if ai.HasMinisign() {
+		if hasOkSig {
+			fmt.Print("\t           ")
+		}
+		if signer, ok, _ := ai.Minisign(); ok {
+			fmt.Printf("%s, minisign [Key ID: %s] %s\n", yes, signer.IDString(), trustString(ai.ID(), trust.KeyFromMinisign(signer), nocolor))
+		} else {
+			fmt.Printf("%s\n", nocolor.Format("minisign signature does not verify"))
+		}
+		hasOkSig = true
+	}
+	if _, err := os.Stat(path + sigstore.BundleSuffix); err == nil {
+		if hasOkSig {
+			fmt.Print("\t           ")
+		}
+		key, err := trust.BundleSigner(path)
+		switch {
+		case err != nil:
+			fmt.Printf("%s\n", nocolor.Format("Sigstore bundle does not verify"))
+		case key == nil:
+			fmt.Printf("Sigstore bundle found, but there's no trusted root at %s to verify it\n", sigstore.RootPath())
+		default:
+			fmt.Printf("%s, Sigstore [%s] %s\n", yes, key.Fingerprint, trustString(ai.ID(), key, nocolor))
+			idprint := fancy.Print{}
+			idprint.Color(fancy.Yellow)
+			fmt.Printf("\t           %s: %s\n", idprint.Format("Identity"), key.Identities[0])
+		}
+		hasOkSig = true
+	}
 	if !hasOkSig {
 		fmt.Printf("%s\n", no)
 	}
@@ -441,6 +1474,35 @@ func printAppImageDetails(path string) error {
 	return nil
 }
 
+// trustString describes whether signer is the key in the trust store for id
+func trustString(id appimage.AppImageID, signer *trust.Key, warn fancy.Print) string {
+	store, err := trust.Load()
+	if err != nil {
+		return warn.Format("(trust store unreadable: " + err.Error() + ")")
+	}
+	imported, err := trust.IsImported(signer.Fingerprint)
+	if err != nil {
+		return warn.Format("(" + err.Error() + ")")
+	}
+	known := store.Get(id)
+	if known == nil {
+		if imported {
+			return "(trusted, imported key)"
+		}
+		return "(trust on first use, not seen before)"
+	}
+	if store.Check(id, signer) != nil {
+		return warn.Format("(NOT the key trusted for this ID: " + known.Fingerprint + ")")
+	}
+	if imported {
+		return "(trusted, imported key)"
+	}
+	if known.Pinned {
+		return "(pinned)"
+	}
+	return fmt.Sprintf("(trust on first use, since %s)", known.FirstSeen.Local().Format("2006-01-02"))
+}
+
 func findAppImagefromCLIArgs(name string, id bool) string {
 	if id {
 		path, found, err := integrate.FindImageById(appimage.AppImageID(name))
@@ -481,14 +1543,29 @@ type progressReport struct {
 	err        error
 	jobindex   int
 	appname    string
+	notice     string
 }
 
 type upgradeJob struct {
 	appImagePath string
 	jobindex     int
+	opts         integrate.Options
 }
 
-func parallelUpgrade(filesToProcess []string) {
+// parseAuditLevel parses the severity given to -audit, empty if s is empty
+func parseAuditLevel(s string) audit.Severity {
+	if s == "" {
+		return ""
+	}
+	sev, err := audit.ParseSeverity(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"%s\n", err)
+		os.Exit(1)
+	}
+	return sev
+}
+
+func parallelUpgrade(filesToProcess []string, opts integrate.Options) {
 	const maxConcurrency = 10
 
 	percentDone := make(chan progressReport)
@@ -516,7 +1593,7 @@ func parallelUpgrade(filesToProcess []string) {
 	//go routine to feed workers
 	go func() {
 		for i := range filesToProcess {
-			jobject := upgradeJob{appImagePath: filesToProcess[i], jobindex: i}
+			jobject := upgradeJob{appImagePath: filesToProcess[i], jobindex: i, opts: opts}
 			jobs <- jobject
 		}
 		close(jobs)
@@ -526,6 +1603,7 @@ func parallelUpgrade(filesToProcess []string) {
 	fp.Color(fancy.Cyan)
 
 	errors := make([]error, len(filesToProcess))
+	var notices []string
 
 	// status printer
 	for {
@@ -541,6 +1619,9 @@ func parallelUpgrade(filesToProcess []string) {
 			errors[status.jobindex] = fmt.Errorf("Error updating '%s': %w\n", status.appname, status.err)
 			continue
 		}
+		if status.notice != "" {
+			notices = append(notices, fmt.Sprintf("%s: %s", status.appname, status.notice))
+		}
 		fancy.CursorRestore()
 		fancy.CursorUp(status.id + 1)
 		fancy.CursorColumn(0)
@@ -551,6 +1632,9 @@ func parallelUpgrade(filesToProcess []string) {
 
 	fancy.CursorRestore()
 
+	for _, n := range notices {
+		fmt.Printf(INFO+"%s\n", n)
+	}
 	for _, err := range errors {
 		if err != nil {
 			fmt.Printf(ERROR+" %s\n", err)
@@ -563,13 +1647,13 @@ newjob:
 	for job := range jobs {
 
 		progress := make(chan update.Progress)
-		go update.AppImage(job.appImagePath, progress)
+		go update.AppImage(job.appImagePath, job.opts, progress)
 		for p := range progress {
 			if p.Err != nil {
 				status <- progressReport{id: workerid, percent: 100, appname: p.AppName, text: "Error", err: p.Err}
 				break newjob
 			}
-			status <- progressReport{id: workerid, percent: p.Percent, appname: p.AppName, text: p.Text}
+			status <- progressReport{id: workerid, percent: p.Percent, appname: p.AppName, text: p.Text, notice: p.Notice}
 		}
 
 	}
@@ -606,13 +1690,15 @@ func listFiles(aiPath, internalPath string, usebytes bool) {
 			}
 			target, err := ai.FS.Open(targetname)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Couldn't read symlink pointing to %s: %s", targetname, err)
-			}
-			targetstat, err := target.Stat()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Couldn't stat symlink target %s: %s", sqinfo.SymlinkTarget(), err)
+				// dangling symlink, nothing to colorize
+				linkTarget += sqinfo.SymlinkTarget()
+			} else {
+				targetstat, err := target.Stat()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Couldn't stat symlink target %s: %s", sqinfo.SymlinkTarget(), err)
+				}
+				linkTarget += colorizeFilename(sqinfo.SymlinkTarget(), targetstat)
 			}
-			linkTarget += colorizeFilename(sqinfo.SymlinkTarget(), targetstat)
 		}
 		name := colorizeFilename(e.Name(), info)
 		var size string
@@ -643,6 +1729,135 @@ func isExecutableBySomeone(mode os.FileMode) bool {
 	return mode&0111 != 0
 }
 
+func fsckImage(aiPath string) (ok bool) {
+	ai := ai(aiPath)
+	defer ai.Close()
+
+	report := squashFSOrExit(ai).Fsck()
+
+	fmt.Printf("Checked %d inodes: %d directories, %d files, %d symlinks. Read %d data blocks and %d fragment blocks.\n",
+		report.Inodes, report.Directories, report.Files, report.Symlinks, report.Blocks, report.Fragments)
+
+	if report.TrailingBytes > 0 {
+		fmt.Printf(WARNING+"%d bytes of unexpected data after the end of the filesystem\n", report.TrailingBytes)
+	}
+
+	if report.OK() {
+		fmt.Printf(INFO + "No problems found.\n")
+		return true
+	}
+
+	yellow := fancy.Print{}
+	yellow.Color(fancy.Yellow)
+	for _, p := range report.Problems {
+		if p.Path != "" {
+			fmt.Printf(ERROR+"%s: %s\n", yellow.Format(p.Path), p.Err)
+		} else {
+			fmt.Printf(ERROR+"%s\n", p.Err)
+		}
+	}
+	fmt.Printf("\n%d problems found. This AppImage is corrupted, consider downloading it again.\n", len(report.Problems))
+	return false
+}
+
+func printFSInfo(aiPath string, nLargest, depth int, usebytes bool) {
+	ai := ai(aiPath)
+	defer ai.Close()
+
+	size := func(n uint64) string {
+		if usebytes {
+			return fmt.Sprintf("%d", n)
+		}
+		return strings.TrimSpace(bytesz.Format(n))
+	}
+	percent := func(part, whole uint64) float64 {
+		if whole == 0 {
+			return 0
+		}
+		return float64(part) / float64(whole) * 100
+	}
+
+	sqfs := squashFSOrExit(ai)
+	sb := sqfs.Superblock()
+	stats, err := sqfs.Stats(nLargest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"Couldn't read filesystem: %s\n", err)
+		os.Exit(1)
+	}
+
+	yellow := fancy.Print{}
+	yellow.Color(fancy.Yellow)
+
+	flags := strings.Join(sb.FlagNames(), ", ")
+	if flags == "" {
+		flags = "none"
+	}
+
+	fmt.Printf("%s: squashfs %d.%d\n", yellow.Format("Filesystem"), sb.VersionMajor, sb.VersionMinor)
+	fmt.Printf("%s: %s\n", yellow.Format("Compression"), sb.CompressionName())
+	fmt.Printf("%s: %s\n", yellow.Format("Block size"), size(uint64(sb.BlockSize)))
+	fmt.Printf("%s: %s\n", yellow.Format("Flags"), flags)
+	fmt.Printf("%s: %d\n", yellow.Format("Inodes"), sb.InodeCount)
+	fmt.Printf("%s: %s\n", yellow.Format("Created"), sb.CreationTime().Format("Jan 02 2006 15:04"))
+	fmt.Printf("%s: %s\n", yellow.Format("Filesystem size"), size(sb.BytesUsed))
+	fmt.Println()
+	fmt.Printf("%s: %d files, %d directories, %d symlinks, %d other\n", yellow.Format("Contents"), stats.Files, stats.Directories, stats.Symlinks, stats.Other)
+	fmt.Printf("%s: %s\n", yellow.Format("Uncompressed size"), size(stats.UncompressedSize))
+	fmt.Printf("%s: %s (%.1f%% of uncompressed)\n", yellow.Format("Compressed data"), size(stats.CompressedSize), percent(stats.CompressedSize, stats.UncompressedSize))
+	fmt.Printf("%s: %s\n", yellow.Format("Metadata"), size(stats.MetadataSize))
+	fmt.Printf("%s: %d (%d sparse)\n", yellow.Format("Data blocks"), stats.DataBlocks, stats.SparseBlocks)
+	fmt.Printf("%s: %d, holding the tails of %d files\n", yellow.Format("Fragment blocks"), stats.FragmentBlocks, stats.FragmentedFiles)
+	fmt.Printf("%s: %d (%s deduplicated)\n", yellow.Format("Duplicate files"), stats.DuplicateFiles, size(stats.DuplicateSize))
+
+	cyan := fancy.Print{}
+	cyan.Color(fancy.Cyan)
+	normal := fancy.Print{}
+
+	fmt.Println()
+	tbl := newTable(14, 14, 8, -1).withFormatters(normal, normal, normal, cyan)
+	tbl.printHead("Size", "Compressed", "Files", "Directory")
+	shown := 0
+	for _, d := range stats.Dirs {
+		if d.Depth > depth || shown >= nLargest {
+			continue
+		}
+		shown++
+		p := "/" + d.Path
+		if d.Path == "." {
+			p = "/"
+		}
+		tbl.printRow(size(d.Size), size(d.CompressedSize), fmt.Sprintf("%d", d.Files), p)
+	}
+
+	fmt.Println()
+	tbl = newTable(14, 14, -1).withFormatters(normal, normal, cyan)
+	tbl.printHead("Size", "Compressed", "File")
+	for _, f := range stats.LargestFiles {
+		tbl.printRow(size(f.Size), size(f.CompressedSize), "/"+f.Path)
+	}
+}
+
+func serveFS(aiPath, addr string) {
+	ai := ai(aiPath)
+	defer ai.Close()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"Couldn't listen on '%s': %s\n", addr, err)
+		os.Exit(1)
+	}
+
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+		fmt.Printf(WARNING+"%s is not a loopback address, the AppImage's contents will be reachable from the network\n", tcpAddr.IP)
+	}
+	fmt.Printf(INFO+"Serving '%s' on http://%s/ (Ctrl+C to stop)\n", aiPath, listener.Addr())
+
+	if err := http.Serve(listener, http.FileServer(http.FS(ai.FS))); err != nil {
+		fmt.Fprintf(os.Stderr, ERROR+"HTTP server failed: %s\n", err)
+		os.Exit(1)
+	}
+}
+
 func catFile(aiPath, internalPath string) {
 	ai := ai(aiPath)
 
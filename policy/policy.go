@@ -0,0 +1,265 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lawl/ayy/appimage"
+	"github.com/lawl/ayy/trust"
+	"github.com/lawl/ayy/xdg"
+)
+
+// the policy restricts which AppImages may be installed, upgraded and aliased, e.g.
+//
+//	{
+//		"require_signature": true,
+//		"signature_exceptions": ["ayy_gh-someone-tool-latest"],
+//		"allowed_keys": ["D992CF59A8DAE6553BDEE870B810DBB22A60AB1E", "E7620F1842B4E81F"],
+//		"allowed_identities": [{"issuer": "https://token.actions.githubusercontent.com", "subject": "https://github.com/someone/tool/.github/workflows/release.yml@refs/tags/*"}],
+//		"allowed_update_hosts": ["github.com"],
+//		"allowed_ids": ["org.example.*", "ayy_gh-*"]
+//	}
+//
+// rules that are left out don't restrict anything
+
+type Policy struct {
+	// AppImages must be signed
+	RequireSignature bool `json:"require_signature"`
+	// IDs that don't have to be signed, and may be signed by any key
+	SignatureExceptions []string `json:"signature_exceptions"`
+	// signed AppImages must be signed by one of these keys, by OpenPGP fingerprint or minisign key ID,
+	// or by one of the allowed identities
+	AllowedKeys []string `json:"allowed_keys"`
+	// Sigstore identities signed AppImages may be signed by, or by one of the allowed keys
+	AllowedIdentities []Identity `json:"allowed_identities"`
+	// AppImages may only update from these hosts
+	AllowedUpdateHosts []string `json:"allowed_update_hosts"`
+	// only AppImages with these IDs are allowed, shell patterns like "org.example.*" work
+	AllowedIDs []string `json:"allowed_ids"`
+}
+
+// Identity matches Sigstore identities. * matches anything in both, / too, as subjects tend to be URLs.
+type Identity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+}
+
+// Error explains which rule of the policy blocked something
+type Error struct {
+	Rule   string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("blocked by policy rule '%s': %s", e.Rule, e.Reason)
+}
+
+// ErrBlocked matches every *Error with errors.Is()
+var ErrBlocked = errors.New("blocked by policy")
+
+func (e *Error) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// Path returns where the policy is read from
+func Path() string {
+	return filepath.Join(xdg.Get(xdg.CONFIG_HOME), "ayy", "policy.json")
+}
+
+// Load reads the policy. Without a policy file everything is allowed.
+func Load() (*Policy, error) {
+	p := Policy{}
+	buf, err := os.ReadFile(Path())
+	if errors.Is(err, os.ErrNotExist) {
+		return &p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a misspelled rule would silently allow everything it was meant to forbid
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("policy '%s' is invalid: %w", Path(), err)
+	}
+	for _, patterns := range [][]string{p.AllowedIDs, p.SignatureExceptions} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("policy '%s' is invalid: bad ID pattern '%s'", Path(), pattern)
+			}
+		}
+	}
+	for _, ident := range p.AllowedIdentities {
+		if ident.Issuer == "" || ident.Subject == "" {
+			return nil, fmt.Errorf("policy '%s' is invalid: allowed identities need an issuer and a subject", Path())
+		}
+	}
+	for i, fp := range p.AllowedKeys {
+		p.AllowedKeys[i] = strings.ToUpper(strings.ReplaceAll(fp, " ", ""))
+	}
+	return &p, nil
+}
+
+func matchID(patterns []string, id appimage.AppImageID) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, string(id)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check evaluates the policy for ai, signed by key, as returned by trust.FileSigner(), nil if it isn't signed.
+// The signatures must already be verified. Returns every rule that blocks ai, nil if it's allowed.
+func (p *Policy) Check(ai *appimage.AppImage, key *trust.Key) []*Error {
+	var errs []*Error
+	id := ai.ID()
+
+	if len(p.AllowedIDs) > 0 && !matchID(p.AllowedIDs, id) {
+		errs = append(errs, &Error{"allowed_ids", fmt.Sprintf("ID '%s' is not allowed", id)})
+	}
+
+	if !matchID(p.SignatureExceptions, id) {
+		if p.RequireSignature && key == nil {
+			errs = append(errs, &Error{"require_signature", fmt.Sprintf("'%s' is not signed", id)})
+		}
+		if key != nil && !p.signerAllowed(key) {
+			errs = append(errs, &Error{p.signerRule(), fmt.Sprintf("'%s' is signed by %s, which is not allowed", id, strings.Join(key.Fingerprints(), " and "))})
+		}
+	}
+
+	if len(p.AllowedUpdateHosts) > 0 {
+		if updInfo, err := ai.UpdateInfo(); err == nil && updInfo != "" {
+			host, err := updateHost(updInfo)
+			if err != nil {
+				errs = append(errs, &Error{"allowed_update_hosts", err.Error()})
+			} else if err := p.CheckUpdateHost(host); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// signerAllowed returns whether any of the keys that signed is allowed
+func (p *Policy) signerAllowed(key *trust.Key) bool {
+	if len(p.AllowedKeys) == 0 && len(p.AllowedIdentities) == 0 {
+		return true
+	}
+	for _, k := range key.All() {
+		if k.Scheme == trust.SchemeSigstore {
+			for _, ident := range p.AllowedIdentities {
+				if matchWildcard(ident.Issuer, k.Issuer) && matchWildcard(ident.Subject, k.Identities[0]) {
+					return true
+				}
+			}
+			continue
+		}
+		for _, fp := range p.AllowedKeys {
+			if fp == k.Fingerprint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchWildcard matches s against pattern, where * matches any string
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
+
+// signerRule names the rules signerAllowed() checks
+func (p *Policy) signerRule() string {
+	switch {
+	case len(p.AllowedIdentities) == 0:
+		return "allowed_keys"
+	case len(p.AllowedKeys) == 0:
+		return "allowed_identities"
+	}
+	return "allowed_keys/allowed_identities"
+}
+
+// CheckUpdateHost checks that updates may be downloaded from host
+func (p *Policy) CheckUpdateHost(host string) *Error {
+	if len(p.AllowedUpdateHosts) == 0 {
+		return nil
+	}
+	for _, h := range p.AllowedUpdateHosts {
+		if strings.EqualFold(h, host) {
+			return nil
+		}
+	}
+	return &Error{"allowed_update_hosts", fmt.Sprintf("updates from '%s' are not allowed", host)}
+}
+
+// updateHost returns the host the update information points to
+func updateHost(updInfo string) (string, error) {
+	spl := strings.Split(strings.TrimSpace(updInfo), "|")
+	switch strings.TrimSpace(spl[0]) {
+	case "zsync":
+		if len(spl) < 2 {
+			return "", errors.New("zsync update information has no URL")
+		}
+		u, err := url.Parse(strings.TrimSpace(spl[1]))
+		if err != nil {
+			return "", fmt.Errorf("invalid zsync URL: %w", err)
+		}
+		return u.Hostname(), nil
+	case "gh-releases-zsync":
+		return "github.com", nil
+	default:
+		return "", fmt.Errorf("can't tell where update information '%s' updates from", updInfo)
+	}
+}
+
+// Join combines the errors returned by Check() into one, nil if there are none
+func Join(errs []*Error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = fmt.Sprintf("rule '%s': %s", e.Rule, e.Reason)
+	}
+	return fmt.Errorf("%w: %s", ErrBlocked, strings.Join(msgs, "; "))
+}
+
+// Evaluate loads the policy and checks the AppImage ai, read from path, against it, verifying its signatures
+func Evaluate(ai *appimage.AppImage, path string) ([]*Error, error) {
+	p, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	key, err := trust.FileSigner(ai, path)
+	if err != nil {
+		return nil, err
+	}
+	return p.Check(ai, key), nil
+}
@@ -0,0 +1,157 @@
+package sigstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/lawl/ayy/xdg"
+)
+
+// Sigstore bundles, as cosign sign-blob --bundle and sigstore-python create them, verified offline
+// against a trusted root, the same JSON the sigstore clients get via TUF, e.g. from
+// https://github.com/sigstore/root-signing/blob/main/targets/trusted_root.json
+//
+// formats: https://github.com/sigstore/protobuf-specs, encoded as protobuf JSON
+
+// Bundle is a Sigstore bundle, only the parts needed for a signature over a file
+type Bundle struct {
+	MediaType            string `json:"mediaType"`
+	VerificationMaterial struct {
+		X509CertificateChain *struct {
+			Certificates []rawBytes `json:"certificates"`
+		} `json:"x509CertificateChain"`
+		// bundle v0.3 has only the leaf certificate
+		Certificate *rawBytes   `json:"certificate"`
+		PublicKey   *struct{}   `json:"publicKey"`
+		TlogEntries []TlogEntry `json:"tlogEntries"`
+	} `json:"verificationMaterial"`
+	MessageSignature *struct {
+		MessageDigest *struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+	DSSEEnvelope *struct{} `json:"dsseEnvelope"`
+}
+
+// TlogEntry is the Rekor transparency log entry of a bundle
+type TlogEntry struct {
+	LogIndex protoInt64 `json:"logIndex"`
+	LogID    struct {
+		KeyID []byte `json:"keyId"`
+	} `json:"logId"`
+	KindVersion struct {
+		Kind    string `json:"kind"`
+		Version string `json:"version"`
+	} `json:"kindVersion"`
+	IntegratedTime   protoInt64 `json:"integratedTime"`
+	InclusionPromise *struct {
+		SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+	} `json:"inclusionPromise"`
+	CanonicalizedBody []byte `json:"canonicalizedBody"`
+}
+
+type rawBytes struct {
+	RawBytes []byte `json:"rawBytes"`
+}
+
+// protobuf JSON encodes 64 bit integers as strings
+type protoInt64 int64
+
+func (i *protoInt64) UnmarshalJSON(b []byte) error {
+	s := string(bytes.Trim(b, `"`))
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", b)
+	}
+	*i = protoInt64(n)
+	return nil
+}
+
+type validFor struct {
+	Start *time.Time `json:"start"`
+	End   *time.Time `json:"end"`
+}
+
+// contains returns whether t is within the period, open ends are unbounded
+func (v validFor) contains(t time.Time) bool {
+	if v.Start != nil && t.Before(*v.Start) {
+		return false
+	}
+	if v.End != nil && t.After(*v.End) {
+		return false
+	}
+	return true
+}
+
+// TrustedRoot holds the certificate authorities and transparency logs to verify bundles with
+type TrustedRoot struct {
+	MediaType string `json:"mediaType"`
+	Tlogs     []struct {
+		BaseURL   string `json:"baseUrl"`
+		PublicKey struct {
+			RawBytes []byte   `json:"rawBytes"`
+			ValidFor validFor `json:"validFor"`
+		} `json:"publicKey"`
+		LogID struct {
+			KeyID []byte `json:"keyId"`
+		} `json:"logId"`
+	} `json:"tlogs"`
+	CertificateAuthorities []struct {
+		URI       string `json:"uri"`
+		CertChain struct {
+			Certificates []rawBytes `json:"certificates"`
+		} `json:"certChain"`
+		ValidFor validFor `json:"validFor"`
+	} `json:"certificateAuthorities"`
+}
+
+// BundleSuffix is appended to an AppImage's path, or its download URL, to find its Sigstore bundle
+const BundleSuffix = ".sigstore.json"
+
+// RootPath returns where the trusted root is read from
+func RootPath() string {
+	return filepath.Join(xdg.Get(xdg.CONFIG_HOME), "ayy", "sigstore", "trusted_root.json")
+}
+
+// LoadTrustedRoot reads the trusted root. Returns nil, nil if there is none, then bundles can't be verified.
+func LoadTrustedRoot() (*TrustedRoot, error) {
+	buf, err := os.ReadFile(RootPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r TrustedRoot
+	if err := json.Unmarshal(buf, &r); err != nil {
+		return nil, fmt.Errorf("sigstore trusted root '%s' is invalid: %w", RootPath(), err)
+	}
+	if len(r.CertificateAuthorities) == 0 || len(r.Tlogs) == 0 {
+		return nil, fmt.Errorf("sigstore trusted root '%s' has no certificate authorities or no transparency logs", RootPath())
+	}
+	return &r, nil
+}
+
+// ReadBundle reads the bundle at path. Returns nil, nil if path doesn't exist.
+func ReadBundle(path string) (*Bundle, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var b Bundle
+	if err := json.Unmarshal(buf, &b); err != nil {
+		return nil, fmt.Errorf("sigstore bundle '%s' is invalid: %w", path, err)
+	}
+	return &b, nil
+}
@@ -0,0 +1,305 @@
+package sigstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // for crypto.SHA384 and SHA512
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is returned if a bundle doesn't verify
+var ErrInvalid = errors.New("sigstore bundle does not verify")
+
+// Identity is who signed, as vouched for by the certificate authority
+type Identity struct {
+	// email address or URI, e.g. a CI workflow
+	Subject string
+	// the OIDC issuer that authenticated Subject
+	Issuer string
+	// when the signature was logged
+	SignedAt time.Time
+}
+
+func (id *Identity) String() string {
+	return fmt.Sprintf("%s (%s)", id.Subject, id.Issuer)
+}
+
+var (
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+	// deprecated, the raw string instead of DER
+	oidIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+)
+
+var digestAlgorithms = map[string]struct {
+	hash  crypto.Hash
+	rekor string
+}{
+	"":         {crypto.SHA256, "sha256"},
+	"SHA2_256": {crypto.SHA256, "sha256"},
+	"SHA2_384": {crypto.SHA384, "sha384"},
+	"SHA2_512": {crypto.SHA512, "sha512"},
+}
+
+func invalid(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, a...))
+}
+
+// Verify verifies that b is a signature over artifact, by a certificate issued by one of the
+// certificate authorities in r, and logged in one of the transparency logs in r.
+// The log entry's signed timestamp is the time the certificate must have been valid at, so nothing
+// is looked up online. Certificate transparency isn't checked.
+func (r *TrustedRoot) Verify(b *Bundle, artifact io.Reader) (*Identity, error) {
+	if b.MessageSignature == nil {
+		if b.DSSEEnvelope != nil {
+			return nil, invalid("DSSE attestations are not supported, only signatures over the file")
+		}
+		return nil, invalid("bundle has no signature")
+	}
+	leaf, err := b.leaf()
+	if err != nil {
+		return nil, err
+	}
+
+	var alg string
+	if md := b.MessageSignature.MessageDigest; md != nil {
+		alg = md.Algorithm
+	}
+	digestAlg, ok := digestAlgorithms[alg]
+	if !ok {
+		return nil, invalid("unsupported digest algorithm '%s'", alg)
+	}
+	h := digestAlg.hash.New()
+	if _, err := io.Copy(h, artifact); err != nil {
+		return nil, err
+	}
+	digest := h.Sum(nil)
+	if md := b.MessageSignature.MessageDigest; md != nil && !bytes.Equal(md.Digest, digest) {
+		return nil, invalid("file digest is %x, but the bundle is for %x", digest, md.Digest)
+	}
+	sig := b.MessageSignature.Signature
+	if err := verifyDigest(leaf.PublicKey, digestAlg.hash, digest, sig); err != nil {
+		return nil, invalid("signature: %v", err)
+	}
+
+	signedAt, err := r.verifyTlog(b, leaf, digestAlg.rekor, digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.verifyChain(leaf, signedAt); err != nil {
+		return nil, err
+	}
+
+	id := Identity{SignedAt: signedAt}
+	switch {
+	case len(leaf.EmailAddresses) > 0:
+		id.Subject = leaf.EmailAddresses[0]
+	case len(leaf.URIs) > 0:
+		id.Subject = leaf.URIs[0].String()
+	default:
+		return nil, invalid("certificate has no email or URI identity")
+	}
+	for _, ext := range leaf.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			if _, err := asn1.Unmarshal(ext.Value, &id.Issuer); err != nil {
+				return nil, invalid("certificate's issuer extension: %v", err)
+			}
+		case ext.Id.Equal(oidIssuerV1) && id.Issuer == "":
+			id.Issuer = string(ext.Value)
+		}
+	}
+	if id.Issuer == "" {
+		return nil, invalid("certificate has no OIDC issuer")
+	}
+	return &id, nil
+}
+
+// leaf returns the signing certificate
+func (b *Bundle) leaf() (*x509.Certificate, error) {
+	vm := b.VerificationMaterial
+	var raw []byte
+	switch {
+	case vm.Certificate != nil:
+		raw = vm.Certificate.RawBytes
+	case vm.X509CertificateChain != nil && len(vm.X509CertificateChain.Certificates) > 0:
+		raw = vm.X509CertificateChain.Certificates[0].RawBytes
+	case vm.PublicKey != nil:
+		return nil, invalid("bundles signed with a bare public key are not supported, only with a certificate")
+	default:
+		return nil, invalid("bundle has no certificate")
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, invalid("certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// verifyTlog checks that a transparency log from r promised to log exactly this signature,
+// and returns when it did
+func (r *TrustedRoot) verifyTlog(b *Bundle, leaf *x509.Certificate, rekorAlg string, digest []byte) (time.Time, error) {
+	if len(b.VerificationMaterial.TlogEntries) == 0 {
+		return time.Time{}, invalid("bundle has no transparency log entry")
+	}
+	var lastErr error
+	for _, e := range b.VerificationMaterial.TlogEntries {
+		t, err := r.verifyTlogEntry(e, leaf, rekorAlg, digest, b.MessageSignature.Signature)
+		if err == nil {
+			return t, nil
+		}
+		lastErr = err
+	}
+	return time.Time{}, lastErr
+}
+
+func (r *TrustedRoot) verifyTlogEntry(e TlogEntry, leaf *x509.Certificate, rekorAlg string, digest, sig []byte) (time.Time, error) {
+	integrated := time.Unix(int64(e.IntegratedTime), 0)
+	if e.InclusionPromise == nil {
+		return time.Time{}, invalid("transparency log entry %d has no signed entry timestamp, which is needed offline", e.LogIndex)
+	}
+
+	var logKey []byte
+	for _, tl := range r.Tlogs {
+		if bytes.Equal(tl.LogID.KeyID, e.LogID.KeyID) && tl.PublicKey.ValidFor.contains(integrated) {
+			logKey = tl.PublicKey.RawBytes
+			break
+		}
+	}
+	if logKey == nil {
+		return time.Time{}, invalid("transparency log %x is not in the trusted root", e.LogID.KeyID)
+	}
+	pub, err := x509.ParsePKIXPublicKey(logKey)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("sigstore trusted root: transparency log key: %w", err)
+	}
+
+	// rekor signs the canonical JSON of these, keys sorted
+	payload, err := json.Marshal(struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogID          string `json:"logID"`
+		LogIndex       int64  `json:"logIndex"`
+	}{
+		base64.StdEncoding.EncodeToString(e.CanonicalizedBody),
+		int64(e.IntegratedTime),
+		hex.EncodeToString(e.LogID.KeyID),
+		int64(e.LogIndex),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	set := e.InclusionPromise.SignedEntryTimestamp
+	if edpub, ok := pub.(ed25519.PublicKey); ok {
+		err = nil
+		if !ed25519.Verify(edpub, payload, set) {
+			err = errors.New("ed25519 verification failure")
+		}
+	} else {
+		sum := sha256.Sum256(payload)
+		err = verifyDigest(pub, crypto.SHA256, sum[:], set)
+	}
+	if err != nil {
+		return time.Time{}, invalid("signed entry timestamp of transparency log entry %d: %v", e.LogIndex, err)
+	}
+
+	// the promise is worthless if the entry is for something else
+	if e.KindVersion.Kind != "hashedrekord" {
+		return time.Time{}, invalid("transparency log entry %d is a '%s', expected a hashedrekord", e.LogIndex, e.KindVersion.Kind)
+	}
+	var body struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content   []byte `json:"content"`
+				PublicKey struct {
+					Content []byte `json:"content"`
+				} `json:"publicKey"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(e.CanonicalizedBody, &body); err != nil {
+		return time.Time{}, invalid("transparency log entry %d: %v", e.LogIndex, err)
+	}
+	hash := body.Spec.Data.Hash
+	if body.Kind != "hashedrekord" || hash.Algorithm != rekorAlg || !strings.EqualFold(hash.Value, hex.EncodeToString(digest)) {
+		return time.Time{}, invalid("transparency log entry %d is for a different file", e.LogIndex)
+	}
+	if !bytes.Equal(body.Spec.Signature.Content, sig) {
+		return time.Time{}, invalid("transparency log entry %d is for a different signature", e.LogIndex)
+	}
+	block, _ := pem.Decode(body.Spec.Signature.PublicKey.Content)
+	if block == nil || !bytes.Equal(block.Bytes, leaf.Raw) {
+		return time.Time{}, invalid("transparency log entry %d is for a different certificate", e.LogIndex)
+	}
+	return integrated, nil
+}
+
+// verifyChain checks that leaf was issued by a certificate authority from r, and valid at t
+func (r *TrustedRoot) verifyChain(leaf *x509.Certificate, t time.Time) error {
+	var lastErr error = invalid("no certificate authority in the trusted root was valid at %s", t.UTC().Format(time.RFC3339))
+	for _, ca := range r.CertificateAuthorities {
+		if !ca.ValidFor.contains(t) || len(ca.CertChain.Certificates) == 0 {
+			continue
+		}
+		roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+		certs := ca.CertChain.Certificates
+		for i, c := range certs {
+			cert, err := x509.ParseCertificate(c.RawBytes)
+			if err != nil {
+				return fmt.Errorf("sigstore trusted root: certificate authority %s: %w", ca.URI, err)
+			}
+			// the chain goes from the intermediates to the root
+			if i == len(certs)-1 {
+				roots.AddCert(cert)
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   t,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		})
+		if err == nil {
+			return nil
+		}
+		lastErr = invalid("certificate: %v", err)
+	}
+	return lastErr
+}
+
+// verifyDigest verifies sig over a digest made with hash
+func verifyDigest(pub crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("ECDSA verification failure")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
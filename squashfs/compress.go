@@ -0,0 +1,111 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression ids as stored in the superblock
+const (
+	CompressionGzip = 1
+	CompressionZstd = 6
+)
+
+// the zstd decoder is safe for concurrent use with DecodeAll
+// and somewhat expensive to set up, so share one
+var zstdDecoder struct {
+	once sync.Once
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (s *SquashFS) uncompress(b []byte) ([]byte, error) {
+	switch s.superblock.CompressionId {
+	case CompressionGzip:
+		return uncompressZlib(b)
+	case CompressionZstd:
+		zstdDecoder.once.Do(func() {
+			zstdDecoder.dec, zstdDecoder.err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		})
+		if zstdDecoder.err != nil {
+			return nil, zstdDecoder.err
+		}
+		return zstdDecoder.dec.DecodeAll(b, nil)
+	default:
+		return nil, unimplemented(fmt.Sprintf("compression type %d", s.superblock.CompressionId))
+	}
+}
+
+func uncompressZlib(b []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(b)
+	r, err := zlib.NewReader(buf)
+	if err != nil {
+		return nil, err
+	}
+	var res bytes.Buffer
+	_, err = res.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	return res.Bytes(), nil
+}
+
+// compressor is the writing side. compress must be safe to call concurrently,
+// and produce the same output for the same input, otherwise images aren't reproducible.
+type compressor interface {
+	id() uint16
+	compress(b []byte) ([]byte, error)
+}
+
+func newCompressor(id uint16, blockSize uint32) (compressor, error) {
+	switch id {
+	case CompressionGzip:
+		return zlibCompressor{}, nil
+	case CompressionZstd:
+		// the kernel only reserves enough memory for windows up to the block size
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+			zstd.WithWindowSize(int(blockSize)),
+			zstd.WithEncoderCRC(false))
+		if err != nil {
+			return nil, err
+		}
+		return zstdCompressor{enc}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression id %d", id)
+	}
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) id() uint16 { return CompressionGzip }
+
+func (zlibCompressor) compress(b []byte) ([]byte, error) {
+	// level 9 is what mksquashfs defaults to
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type zstdCompressor struct {
+	enc *zstd.Encoder
+}
+
+func (zstdCompressor) id() uint16 { return CompressionZstd }
+
+func (z zstdCompressor) compress(b []byte) ([]byte, error) {
+	return z.enc.EncodeAll(b, nil), nil
+}
@@ -1,8 +1,6 @@
 package squashfs
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -11,10 +9,10 @@ import (
 	"time"
 )
 
-//prefixed with i, because the fields are named the same
-//and we only have this interface to dedupe some code
-//between extended and basic file, i don't want to have
-//to always to through getters/setters
+// prefixed with i, because the fields are named the same
+// and we only have this interface to dedupe some code
+// between extended and basic file, i don't want to have
+// to always to through getters/setters
 type SqfsFile interface {
 	iBlocksStart() uint64
 	iFileSize() uint64
@@ -46,6 +44,18 @@ type File struct {
 	currentByteOffset int64
 	haveReadFragment  bool
 	nBytesRead        int
+	// bytes to throw away from the next block we read, after seeking into the middle of it
+	skip int
+
+	// blocks being decompressed in the background, in file order. see SquashFS.SetReadAhead()
+	ahead           []chan blockResult
+	aheadBlockId    int
+	aheadByteOffset int64
+}
+
+type blockResult struct {
+	data []byte
+	err  error
 }
 
 func fileFromBasicFile(s *SquashFS, bf BasicFile, de DirectoryEntry) *File {
@@ -77,7 +87,11 @@ func (f *File) Read(buf []byte) (int, error) {
 	if len(f.databuffer) == 0 {
 		var err error
 		if f.currentBlockId < len(f.bf.iBlockSizes()) {
-			f.databuffer, err = readBlock(f)
+			if f.sqfs.readAhead > 0 {
+				f.databuffer, err = readBlockAhead(f)
+			} else {
+				f.databuffer, err = readBlock(f)
+			}
 			if err != nil {
 				return 0, err
 			}
@@ -89,6 +103,14 @@ func (f *File) Read(buf []byte) (int, error) {
 		} else {
 			return 0, io.EOF
 		}
+		if f.skip > 0 {
+			if f.skip > len(f.databuffer) {
+				return 0, fmt.Errorf("seek offset %d is past the end of the block", f.skip)
+			}
+			f.databuffer = f.databuffer[f.skip:]
+			f.nBytesRead += f.skip
+			f.skip = 0
+		}
 	}
 
 	n := copy(buf, f.databuffer)
@@ -97,86 +119,141 @@ func (f *File) Read(buf []byte) (int, error) {
 	return n, nil
 }
 
-func readBlock(f *File) ([]byte, error) {
-	sqfs := f.sqfs
-	if _, err := sqfs.reader.Seek(int64(f.bf.iBlocksStart())+f.currentByteOffset, io.SeekStart); err != nil {
-		return nil, err
+// Seek implements io.Seeker. Blocks are compressed individually, so this only
+// has to work out which block the offset is in, nothing before it is decompressed.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(f.nBytesRead+f.skip) + offset
+	case io.SeekEnd:
+		pos = int64(f.bf.iFileSize()) + offset
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.de.name, Err: fs.ErrInvalid}
+	}
+	if pos < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.de.name, Err: errors.New("negative position")}
 	}
-	sz := f.bf.iBlockSizes()[f.currentBlockId]
-	f.currentBlockId++
-	f.currentByteOffset += int64(sz)
 
-	block := make([]byte, sz)
-	_, err := io.ReadFull(sqfs.reader, block)
-	if err != nil {
-		return block, err
+	blockSize := int64(f.sqfs.superblock.BlockSize)
+	blockSizes := f.bf.iBlockSizes()
+
+	f.databuffer = nil
+	f.haveReadFragment = false
+	f.skip = 0
+	// anything still being decompressed is for the old position.
+	// the channels are buffered, so the workers won't get stuck on them
+	f.ahead = nil
+
+	if pos >= int64(f.bf.iFileSize()) {
+		// at or past the end, there is nothing left to read
+		f.currentBlockId = len(blockSizes)
+		f.haveReadFragment = true
+		f.nBytesRead = int(pos)
+		return pos, nil
 	}
 
-	// TODO, check if even compressed? or maybe make uncompress a NOP if not
-	b, err := uncompress(block)
-	if err != nil {
-		return block, err
+	block := pos / blockSize
+	if block > int64(len(blockSizes)) {
+		block = int64(len(blockSizes))
+	}
+	f.currentBlockId = int(block)
+	f.currentByteOffset = 0
+	for _, sz := range blockSizes[:block] {
+		f.currentByteOffset += int64(sz &^ blockUncompressed)
 	}
+	// the next Read() starts at the beginning of the block (or the fragment)
+	// and throws away everything up to pos
+	f.nBytesRead = int(block * blockSize)
+	f.skip = int(pos - block*blockSize)
 
-	return b, nil
+	return pos, nil
 }
 
-func readFragment(f *File) ([]byte, error) {
+func readBlock(f *File) ([]byte, error) {
 	sqfs := f.sqfs
+	start := int64(f.bf.iBlocksStart()) + f.currentByteOffset
+	sz := f.bf.iBlockSizes()[f.currentBlockId]
+	expected := f.blockLength(f.currentBlockId)
+	f.currentBlockId++
+	f.currentByteOffset += int64(sz &^ blockUncompressed)
 
-	if sqfs.superblock.Flags&NoFragments == NoFragments {
-		fmt.Fprint(os.Stderr, "Superblock sais fragments aren't used. But File inode sais otherwise. idk man, kinda sus. Fightning the power and ignoring superblock!")
-	}
+	return sqfs.readDataBlock(start, sz, expected)
+}
 
-	noffsets := sqfs.superblock.FragmentEntryCount / 512
-	if sqfs.superblock.FragmentEntryCount%512 != 0 {
-		noffsets++
+// readBlockAhead returns the current block like readBlock, but also keeps the
+// next blocks decompressing in the background, up to the configured read-ahead.
+func readBlockAhead(f *File) ([]byte, error) {
+	sqfs := f.sqfs
+	blockSizes := f.bf.iBlockSizes()
+
+	if len(f.ahead) == 0 {
+		f.aheadBlockId = f.currentBlockId
+		f.aheadByteOffset = f.currentByteOffset
+	}
+	for len(f.ahead) < sqfs.readAhead && f.aheadBlockId < len(blockSizes) {
+		start := int64(f.bf.iBlocksStart()) + f.aheadByteOffset
+		sz := blockSizes[f.aheadBlockId]
+		expected := f.blockLength(f.aheadBlockId)
+
+		ch := make(chan blockResult, 1)
+		workers := sqfs.workers
+		go func() {
+			workers <- struct{}{}
+			data, err := sqfs.readDataBlock(start, sz, expected)
+			<-workers
+			ch <- blockResult{data: data, err: err}
+		}()
+		f.ahead = append(f.ahead, ch)
+
+		f.aheadBlockId++
+		f.aheadByteOffset += int64(sz &^ blockUncompressed)
 	}
 
-	offs := (f.bf.iFragmentBlockIndex() / 512) * 8 // u64 = 8byte
-	if _, err := sqfs.reader.Seek(int64(sqfs.superblock.FragmentTableStart)+int64(offs), io.SeekStart); err != nil {
-		return nil, err
+	res := <-f.ahead[0]
+	f.ahead = f.ahead[1:]
+	f.currentByteOffset += int64(blockSizes[f.currentBlockId] &^ blockUncompressed)
+	f.currentBlockId++
+
+	return res.data, res.err
+}
+
+// blockLength is the uncompressed size of the files n-th data block.
+// that's the block size, except for the last block of files that don't end in a fragment.
+func (f *File) blockLength(n int) int {
+	blockSize := uint64(f.sqfs.superblock.BlockSize)
+	remaining := f.bf.iFileSize() - uint64(n)*blockSize
+	if remaining < blockSize {
+		return int(remaining)
 	}
+	return int(blockSize)
+}
 
-	var metablockoffset uint64
-	if err := binary.Read(sqfs.reader, binary.LittleEndian, &metablockoffset); err != nil {
-		return nil, err
+func readFragment(f *File) ([]byte, error) {
+	sqfs := f.sqfs
+
+	if sqfs.superblock.Flags&NoFragments == NoFragments {
+		fmt.Fprint(os.Stderr, "Superblock sais fragments aren't used. But File inode sais otherwise. idk man, kinda sus. Fightning the power and ignoring superblock!")
 	}
 
-	block, _, err := sqfs.readOneMetaBlock(metablockoffset)
+	fblock, err := sqfs.readFragmentEntry(f.bf.iFragmentBlockIndex())
 	if err != nil {
 		return nil, err
 	}
-	// FragmentBlockEntry = 16 byte.
-	boffset := (f.bf.iFragmentBlockIndex() % 512) * 16
-	blockbuf := bytes.NewBuffer(block[boffset:])
-	fblock := FragmentBlockEntry{}
-	if err := binary.Read(blockbuf, binary.LittleEndian, &fblock); err != nil {
-		return nil, err
-	}
-
-	size := fblock.Size & 0xFFFFFF
-	isUncompressed := fblock.Size&0x1000000 != 0
 
-	compressedBlock := make([]byte, size)
-	if _, err := sqfs.reader.Seek(int64(fblock.Start), io.SeekStart); err != nil {
-		return nil, err
-	}
-	if _, err := io.ReadFull(sqfs.reader, compressedBlock); err != nil {
+	uncompressedBlock, err := sqfs.readDataBlock(int64(fblock.Start), fblock.Size, 0)
+	if err != nil {
 		return nil, err
 	}
-	var uncompressedBlock []byte
-	if isUncompressed {
-		uncompressedBlock = compressedBlock
-	} else {
-		uncompressedBlock, err = uncompress(compressedBlock)
-		if err != nil {
-			return nil, err
-		}
-	}
 	f.haveReadFragment = true
 	maxReadUntil := f.bf.iFileSize() - uint64(f.nBytesRead)
-	return uncompressedBlock[f.bf.iBlockOffset() : uint64(f.bf.iBlockOffset())+maxReadUntil], nil
+	end := uint64(f.bf.iBlockOffset()) + maxReadUntil
+	if end > uint64(len(uncompressedBlock)) {
+		return nil, fmt.Errorf("file tail at offset %d in fragment %d is out of bounds, fragment is only %d bytes", f.bf.iBlockOffset(), f.bf.iFragmentBlockIndex(), len(uncompressedBlock))
+	}
+	return uncompressedBlock[f.bf.iBlockOffset():end], nil
 }
 
 func (f File) Close() error {
@@ -195,11 +272,12 @@ type FileInfo struct {
 	modTime    time.Time
 	mode       uint32
 	size       int64
-	uid        uint16
-	gid        uint16
+	uid        uint32
+	gid        uint32
 
 	symlinkTarget     string
 	symlinkTargetSize int64
+	device            uint32 // as stored in device inodes
 }
 
 // the default file info struct doesn't contain uid/gid, or info about symlinks
@@ -207,11 +285,17 @@ type FileInfo struct {
 // So I suppose callers will have to call Sys()
 // and then dynamically check if it implements the SquashInfo interface.
 type SquashInfo interface {
-	Uid() uint16
-	Gid() uint16
+	Uid() uint32
+	Gid() uint32
 	SymlinkTarget() string
 }
 
+// DeviceInfo is implemented by the Sys() of files from file systems that know the device number
+// of device nodes, like this package's and package iso9660's
+type DeviceInfo interface {
+	DeviceNumber() (major, minor uint32)
+}
+
 func fileInfoFromDirEntry(sqfs *SquashFS, d DirectoryEntry) FileInfo {
 	fileInfo := FileInfo{}
 	fileInfo.dirEntry = d
@@ -235,11 +319,11 @@ func (f FileInfo) Size() int64 {
 func (f FileInfo) Sys() any {
 	return f
 }
-func (f FileInfo) Uid() uint16 {
+func (f FileInfo) Uid() uint32 {
 	f.stat()
 	return f.uid
 }
-func (f FileInfo) Gid() uint16 {
+func (f FileInfo) Gid() uint32 {
 	f.stat()
 	return f.gid
 }
@@ -248,6 +332,13 @@ func (f FileInfo) SymlinkTarget() string {
 	f.stat()
 	return f.symlinkTarget
 }
+
+// DeviceNumber returns the major and minor number of a device node, 0 for anything else
+func (f FileInfo) DeviceNumber() (major, minor uint32) {
+	f.stat()
+	return decodeDevice(f.device)
+}
+
 func (f FileInfo) IsDir() bool {
 	return f.dirEntry.dtype == tBasicDirectory || f.dirEntry.dtype == tExtendedDirectory
 }
@@ -267,10 +358,14 @@ func (f *FileInfo) stat() error {
 		return err
 	}
 	f.modTime = time.Unix(int64(header.ModifiedTime), 0)
-	f.mode = uint32(f.dirEntry.Type()) | uint32(header.Permissions)
+	f.mode = uint32(f.dirEntry.Type() | unixToFileMode(header.Permissions))
 
-	f.uid = header.UidIdx
-	f.gid = header.GidIdx
+	if f.uid, err = sqfs.lookupId(header.UidIdx); err != nil {
+		return err
+	}
+	if f.gid, err = sqfs.lookupId(header.GidIdx); err != nil {
+		return err
+	}
 
 	switch node := inode.(type) {
 	case BasicFile:
@@ -287,6 +382,14 @@ func (f *FileInfo) stat() error {
 		f.size = 0
 		f.symlinkTarget = node.TargetPath
 		f.symlinkTargetSize = int64(node.TargetSize)
+	case BasicDevice:
+		f.size = 0
+		f.device = node.Device
+	case ExtendedDevice:
+		f.size = 0
+		f.device = node.Device
+	case BasicIPC, ExtendedIPC:
+		f.size = 0
 	default:
 		return unimplemented(fmt.Sprintf("unhandled type %T in stat()", node))
 	}
@@ -294,6 +397,47 @@ func (f *FileInfo) stat() error {
 	return nil
 }
 
+// unixToFileMode converts the permission bits stored in inodes to a fs.FileMode.
+// setuid, setgid and sticky are different bits in go than on disk.
+func unixToFileMode(perm uint16) fs.FileMode {
+	mode := fs.FileMode(perm & 0777)
+	if perm&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// device numbers are stored like the kernel's new_encode_dev() does,
+// the low 8 bits of the minor, the major, then the rest of the minor
+func encodeDevice(major, minor uint32) uint32 {
+	return minor&0xff | major<<8 | (minor&^0xff)<<12
+}
+
+func decodeDevice(dev uint32) (major, minor uint32) {
+	return (dev & 0xfff00) >> 8, dev&0xff | (dev>>12)&0xfff00
+}
+
+// fileModeToUnix is the reverse of unixToFileMode
+func fileModeToUnix(mode fs.FileMode) uint16 {
+	perm := uint16(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
 func (d DirectoryEntry) Name() string {
 	return d.name
 }
@@ -306,6 +450,8 @@ func (d DirectoryEntry) Type() fs.FileMode {
 	var mode fs.FileMode
 
 	switch d.dtype {
+	case tBasicFile, tExtendedFile:
+		// regular files don't have a type bit
 	case tBasicDirectory, tExtendedDirectory:
 		mode |= fs.ModeDir
 	case tBasicSymlink, tExtendedSymlink:
@@ -317,7 +463,8 @@ func (d DirectoryEntry) Type() fs.FileMode {
 	case tBasicBlockDevice, tExtendedBlockDevice:
 		mode |= fs.ModeDevice
 	case tBasicCharDevice, tExtendedCharDevice:
-		mode |= fs.ModeCharDevice
+		// io/fs wants both for character devices
+		mode |= fs.ModeDevice | fs.ModeCharDevice
 	default:
 		mode |= fs.ModeIrregular
 	}
@@ -337,7 +484,30 @@ func (d Directory) Read(p []byte) (int, error) {
 	err.Err = errors.New("cannot Read() directory")
 	return 0, &err
 }
+
+// ReadDir implements fs.ReadDirFile
+func (d *Directory) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.readDirPos:]
+	if n > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(remaining) {
+		n = len(remaining)
+	}
+
+	ret := make([]fs.DirEntry, n)
+	for i := range ret {
+		ret[i] = remaining[i]
+	}
+	d.readDirPos += n
+	return ret, nil
+}
+
 func (d Directory) Stat() (fs.FileInfo, error) {
+	if d.pointingEntry.sqfs != nil {
+		// stat the inode like any other entry, so permissions, owner and mtime are there
+		return fileInfoFromDirEntry(d.pointingEntry.sqfs, d.pointingEntry), nil
+	}
 	return DirInfo{dir: d, entry: d.pointingEntry}, nil
 }
 
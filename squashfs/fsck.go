@@ -0,0 +1,483 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// FsckProblem is a single inconsistency found by Fsck
+type FsckProblem struct {
+	// Path inside the filesystem the problem was found at.
+	// empty for problems that don't belong to a specific file,
+	// e.g. in the superblock or the fragment table
+	Path string
+	Err  error
+}
+
+func (p FsckProblem) String() string {
+	if p.Path == "" {
+		return p.Err.Error()
+	}
+	return p.Path + ": " + p.Err.Error()
+}
+
+type FsckReport struct {
+	Problems []FsckProblem
+
+	Inodes      int // inodes found in the inode table
+	Directories int
+	Files       int
+	Symlinks    int
+	Blocks      int // data blocks that were read and decompressed
+	Fragments   int // fragment blocks that were read and decompressed
+
+	// TrailingBytes is how much data there is after the end of the filesystem
+	// (Superblock.BytesUsed, padded to 4KiB like mksquashfs does) up to the end
+	// of the reader passed to New(). Should be 0.
+	TrailingBytes int64
+}
+
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+type scannedInode struct {
+	header InodeHeader
+	inode  any
+}
+
+type fsckFragment struct {
+	size       int // uncompressed
+	ok         bool
+	referenced bool
+}
+
+type fsck struct {
+	s      *SquashFS
+	report *FsckReport
+
+	// inodes found walking the inode table front to back, keyed by inode reference.
+	// scanComplete is false if the table couldn't be walked to the end, inodes
+	// read from the directory tree instead are added as they're found.
+	inodes       map[uint64]scannedInode
+	scanComplete bool
+
+	fragments []fsckFragment
+
+	reached     map[uint64]bool // inode references reachable from the root directory
+	checkedData map[uint64]bool // hard links share their data, only check it once
+	// set if some part of the tree couldn't be read, we then can't tell
+	// which inodes and fragments are really unused
+	walkIncomplete bool
+}
+
+// Fsck checks the filesystem for consistency. It walks the whole inode table,
+// every directory, and reads and decompresses every data and fragment block.
+// It reports decompression failures, out of range offsets, mismatching sizes,
+// unused fragments and inodes that can't be reached from the root directory.
+//
+// Fsck keeps going after finding problems and collects all of them into the report.
+func (s *SquashFS) Fsck() *FsckReport {
+	c := fsck{
+		s:           s,
+		report:      &FsckReport{},
+		inodes:      make(map[uint64]scannedInode),
+		reached:     make(map[uint64]bool),
+		checkedData: make(map[uint64]bool),
+	}
+
+	if !c.checkSuperblock() {
+		// table offsets are garbage, everything else would just explode
+		return c.report
+	}
+	c.checkIdTable()
+	c.checkFragmentTable()
+	c.scanInodeTable()
+
+	rootRef := s.superblock.RootInodeRef
+	c.checkInode("/", rootRef, 0, 0)
+
+	if c.walkIncomplete {
+		return c.report
+	}
+	if c.scanComplete {
+		for ref, si := range c.inodes {
+			if !c.reached[ref] {
+				c.problem("", fmt.Errorf("inode %d (%s) is not reachable from the root directory", si.header.InodeNumber, inodeTypeName(si.header.InodeType)))
+			}
+		}
+	}
+	for i, frag := range c.fragments {
+		if frag.ok && !frag.referenced {
+			c.problem("", fmt.Errorf("fragment block %d is not used by any file", i))
+		}
+	}
+
+	return c.report
+}
+
+func (c *fsck) problem(path string, err error) {
+	c.report.Problems = append(c.report.Problems, FsckProblem{Path: path, Err: err})
+}
+
+func (c *fsck) checkSuperblock() bool {
+	sb := c.s.superblock
+	size := c.s.reader.Size()
+
+	ok := true
+	if sb.BytesUsed > uint64(size) {
+		c.problem("", fmt.Errorf("filesystem is truncated: superblock says it is %d bytes, but only %d bytes are available", sb.BytesUsed, size))
+	} else {
+		padded := (sb.BytesUsed + 4095) &^ 4095
+		if uint64(size) > padded {
+			c.report.TrailingBytes = size - int64(padded)
+		}
+	}
+
+	if sb.BlockSize < 4096 || sb.BlockSize > 1024*1024 {
+		c.problem("", fmt.Errorf("block size %d out of range, must be between 4KiB and 1MiB", sb.BlockSize))
+		ok = false
+	}
+
+	const notPresent = 0xFFFFFFFFFFFFFFFF
+	tables := []struct {
+		name     string
+		start    uint64
+		optional bool
+	}{
+		{"inode table", sb.InodeTableStart, false},
+		{"directory table", sb.DirectoryTableStart, false},
+		{"fragment table", sb.FragmentTableStart, sb.FragmentEntryCount == 0},
+		{"export table", sb.ExportTableStart, true},
+		{"id table", sb.IdTableStart, false},
+		{"xattr id table", sb.XattrIdTableStart, true},
+	}
+	for _, t := range tables {
+		if t.optional && t.start == notPresent {
+			continue
+		}
+		if t.start >= sb.BytesUsed {
+			c.problem("", fmt.Errorf("%s starts at 0x%x, past the end of the filesystem (0x%x)", t.name, t.start, sb.BytesUsed))
+			ok = false
+		}
+	}
+	if sb.InodeTableStart >= sb.DirectoryTableStart {
+		c.problem("", fmt.Errorf("inode table (0x%x) does not start before the directory table (0x%x)", sb.InodeTableStart, sb.DirectoryTableStart))
+		ok = false
+	}
+
+	return ok
+}
+
+func (c *fsck) checkIdTable() {
+	sb := c.s.superblock
+	if sb.IdCount == 0 {
+		c.problem("", errors.New("id table is empty, there must be at least one uid/gid"))
+		return
+	}
+	if _, err := c.s.readLookupTable(sb.IdTableStart, int(sb.IdCount), 4); err != nil {
+		c.problem("", fmt.Errorf("reading id table: %w", err))
+	}
+}
+
+func (c *fsck) checkFragmentTable() {
+	sb := c.s.superblock
+	if sb.FragmentEntryCount == 0 {
+		return
+	}
+	// readLookupTable() checks the count is plausible
+	table, err := c.s.readLookupTable(sb.FragmentTableStart, int(sb.FragmentEntryCount), 16)
+	if err != nil {
+		c.problem("", fmt.Errorf("reading fragment table: %w", err))
+		return
+	}
+	c.fragments = make([]fsckFragment, sb.FragmentEntryCount)
+
+	for i := range c.fragments {
+		entry := FragmentBlockEntry{
+			Start: binary.LittleEndian.Uint64(table[i*16:]),
+			Size:  binary.LittleEndian.Uint32(table[i*16+8:]),
+		}
+		onDisk := entry.Size &^ blockUncompressed
+		if onDisk == 0 || onDisk > sb.BlockSize {
+			c.problem("", fmt.Errorf("fragment block %d: invalid size %d", i, onDisk))
+			continue
+		}
+		if entry.Start+uint64(onDisk) > sb.InodeTableStart {
+			c.problem("", fmt.Errorf("fragment block %d: out of range, %d bytes at 0x%x extend past the start of the inode table", i, onDisk, entry.Start))
+			continue
+		}
+		block, err := c.s.readDataBlock(int64(entry.Start), entry.Size, 0)
+		if err != nil {
+			c.problem("", fmt.Errorf("fragment block %d: %w", i, err))
+			continue
+		}
+		if len(block) > int(sb.BlockSize) {
+			c.problem("", fmt.Errorf("fragment block %d: uncompressed size %d is larger than the block size %d", i, len(block), sb.BlockSize))
+			continue
+		}
+		c.fragments[i] = fsckFragment{size: len(block), ok: true}
+		c.report.Fragments++
+	}
+}
+
+// scanInodeTable reads every inode in the inode table front to back.
+// this is the only way to find inodes that aren't referenced by any directory.
+func (c *fsck) scanInodeTable() {
+	sb := c.s.superblock
+
+	r, err := newBlockReader(c.s, sb.InodeTableStart, 0)
+	if err != nil {
+		c.problem("", fmt.Errorf("reading inode table: %w", err))
+		return
+	}
+	br := r.(*blockReader)
+
+	seenNumbers := make(map[uint32]bool)
+	for {
+		block, offset := br.pos()
+		if block >= sb.DirectoryTableStart {
+			break
+		}
+		ref := (block-sb.InodeTableStart)<<16 | offset
+
+		header, inode, err := readInodeFrom(br, sb.BlockSize)
+		if err != nil {
+			// no way to know where the next inode would start, give up
+			c.problem("", fmt.Errorf("inode table: reading inode at 0x%x, offset %d: %w", block, offset, err))
+			return
+		}
+		c.inodes[ref] = scannedInode{header: header, inode: inode}
+		c.report.Inodes++
+
+		if header.InodeNumber == 0 || header.InodeNumber > sb.InodeCount {
+			c.problem("", fmt.Errorf("inode table: inode number %d out of range 1-%d", header.InodeNumber, sb.InodeCount))
+		} else if seenNumbers[header.InodeNumber] {
+			c.problem("", fmt.Errorf("inode table: inode number %d is used more than once", header.InodeNumber))
+		}
+		seenNumbers[header.InodeNumber] = true
+	}
+
+	if c.report.Inodes != int(sb.InodeCount) {
+		c.problem("", fmt.Errorf("superblock says there are %d inodes, but the inode table has %d", sb.InodeCount, c.report.Inodes))
+	}
+	c.scanComplete = true
+}
+
+// checkInode checks the inode at ref, that a directory entry at path points to.
+// entryType and entryNumber are the type and number the directory entry claims the inode has,
+// 0 to skip that check, e.g. for the root directory which has no entry pointing at it.
+func (c *fsck) checkInode(path string, ref uint64, entryType uint16, entryNumber uint32) bool {
+	si, found := c.inodes[ref]
+	if !found {
+		if c.scanComplete {
+			c.problem(path, fmt.Errorf("points to inode at 0x%x, offset %d, which does not exist in the inode table", ref>>16, ref&0xFFFF))
+			c.walkIncomplete = true
+			return false
+		}
+		// the table scan broke off early, we might still be able to read this one
+		header, inode, err := c.s.readRawInode(ref>>16, ref&0xFFFF)
+		if err != nil {
+			c.problem(path, fmt.Errorf("reading inode: %w", err))
+			c.walkIncomplete = true
+			return false
+		}
+		si = scannedInode{header: header, inode: inode}
+		// the checks on the directory it's in look it up here too
+		c.inodes[ref] = si
+	}
+	header := si.header
+
+	if entryNumber != 0 && header.InodeNumber != entryNumber {
+		c.problem(path, fmt.Errorf("directory entry says inode number %d, inode says %d", entryNumber, header.InodeNumber))
+	}
+	if entryType != 0 && basicInodeType(header.InodeType) != entryType {
+		c.problem(path, fmt.Errorf("directory entry says %s, inode is %s", inodeTypeName(entryType), inodeTypeName(header.InodeType)))
+	}
+
+	if c.reached[ref] {
+		switch si.inode.(type) {
+		case BasicDirectory, ExtendedDirectory:
+			c.problem(path, errors.New("directory is linked more than once, filesystem contains a loop"))
+			return false
+		}
+	}
+	c.reached[ref] = true
+
+	switch node := si.inode.(type) {
+	case BasicDirectory:
+		c.report.Directories++
+		c.checkDirectory(path, header, node, node.BlockStart, node.BlockOffset, uint32(node.FileSize))
+	case ExtendedDirectory:
+		c.report.Directories++
+		c.checkDirectory(path, header, node, node.BlockStart, node.BlockOffset, node.FileSize)
+	case BasicFile:
+		c.report.Files++
+		c.checkFile(path, ref, node)
+	case ExtendedFile:
+		c.report.Files++
+		c.checkFile(path, ref, node)
+	case BasicSymlink:
+		c.report.Symlinks++
+		c.checkSymlink(path, node.TargetSize, node.TargetPath)
+	case ExtendedSymlink:
+		c.report.Symlinks++
+		c.checkSymlink(path, node.TargetSize, node.TargetPath)
+	}
+
+	return true
+}
+
+func (c *fsck) checkDirectory(dirpath string, header InodeHeader, dirInode any, blockStart uint32, blockOffset uint16, fileSize uint32) {
+	if uint64(blockStart)+c.s.superblock.DirectoryTableStart >= c.s.superblock.BytesUsed {
+		c.problem(dirpath, fmt.Errorf("directory listing at 0x%x is out of range", blockStart))
+		c.walkIncomplete = true
+		return
+	}
+
+	var dir Directory
+	var err error
+	switch d := dirInode.(type) {
+	case BasicDirectory:
+		dir, err = readDirectoryTable(c.s, d, blockStart, blockOffset, fileSize)
+	case ExtendedDirectory:
+		dir, err = readDirectoryTable(c.s, d, blockStart, blockOffset, fileSize)
+	}
+	if err != nil {
+		c.problem(dirpath, fmt.Errorf("reading directory listing: %w", err))
+		c.walkIncomplete = true
+		return
+	}
+
+	prev := ""
+	for i, entry := range dir.entries {
+		name := entry.name
+		childPath := path.Join(dirpath, name)
+
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			c.problem(dirpath, fmt.Errorf("invalid file name %q in directory listing", name))
+			continue
+		}
+		if i > 0 && name <= prev {
+			c.problem(childPath, fmt.Errorf("directory listing is not sorted, %q comes after %q", name, prev))
+		}
+		prev = name
+
+		ref := uint64(entry.Start)<<16 | uint64(entry.Offset)
+		if !c.checkInode(childPath, ref, entry.dtype, entry.InodeNumber) {
+			continue
+		}
+
+		var parent uint32
+		isDir := true
+		switch child := c.inodes[ref].inode.(type) {
+		case BasicDirectory:
+			parent = child.ParentInodeNumber
+		case ExtendedDirectory:
+			parent = child.ParentInodeNumber
+		default:
+			isDir = false
+		}
+		if isDir && parent != header.InodeNumber {
+			c.problem(childPath, fmt.Errorf("parent inode number is %d, but directory is in inode %d", parent, header.InodeNumber))
+		}
+	}
+}
+
+func (c *fsck) checkFile(filepath string, ref uint64, file SqfsFile) {
+	if c.checkedData[ref] {
+		return
+	}
+	c.checkedData[ref] = true
+
+	sb := c.s.superblock
+	blockSize := uint64(sb.BlockSize)
+	fileSize := file.iFileSize()
+	start := file.iBlocksStart()
+
+	for i, sz := range file.iBlockSizes() {
+		onDisk := sz &^ blockUncompressed
+		if onDisk > sb.BlockSize {
+			c.problem(filepath, fmt.Errorf("block %d: size %d on disk is larger than the block size %d", i, onDisk, sb.BlockSize))
+			return
+		}
+		if start+uint64(onDisk) > sb.InodeTableStart {
+			c.problem(filepath, fmt.Errorf("block %d: out of range, %d bytes at 0x%x extend past the start of the inode table", i, onDisk, start))
+			return
+		}
+
+		expected := blockSize
+		if remaining := fileSize - uint64(i)*blockSize; remaining < blockSize {
+			expected = remaining
+		}
+		data, err := c.s.readDataBlock(int64(start), sz, int(expected))
+		if err != nil {
+			c.problem(filepath, fmt.Errorf("block %d: %w", i, err))
+		} else if uint64(len(data)) != expected {
+			c.problem(filepath, fmt.Errorf("block %d: uncompressed size is %d, expected %d", i, len(data), expected))
+		}
+		c.report.Blocks++
+		start += uint64(onDisk)
+	}
+
+	if !file.endsInFragment() {
+		return
+	}
+
+	idx := file.iFragmentBlockIndex()
+	if idx >= uint32(len(c.fragments)) {
+		c.problem(filepath, fmt.Errorf("fragment index %d out of range, filesystem has %d fragments", idx, len(c.fragments)))
+		return
+	}
+	frag := &c.fragments[idx]
+	frag.referenced = true
+	if !frag.ok {
+		c.problem(filepath, fmt.Errorf("file ends in broken fragment block %d", idx))
+		return
+	}
+	tail := fileSize - uint64(len(file.iBlockSizes()))*blockSize
+	if uint64(file.iBlockOffset())+tail > uint64(frag.size) {
+		c.problem(filepath, fmt.Errorf("file tail of %d bytes at offset %d does not fit into fragment block %d of %d bytes", tail, file.iBlockOffset(), idx, frag.size))
+	}
+}
+
+func (c *fsck) checkSymlink(path string, targetSize uint32, target string) {
+	if targetSize == 0 || target == "" {
+		c.problem(path, errors.New("symlink has an empty target"))
+	}
+}
+
+// basicInodeType maps extended inode types to their basic counterpart.
+// directory entries always use the basic type.
+func basicInodeType(t uint16) uint16 {
+	if t >= tExtendedDirectory && t <= tExtendedSocket {
+		return t - 7
+	}
+	return t
+}
+
+func inodeTypeName(t uint16) string {
+	names := map[uint16]string{
+		tBasicDirectory:      "directory",
+		tBasicFile:           "file",
+		tBasicSymlink:        "symlink",
+		tBasicBlockDevice:    "block device",
+		tBasicCharDevice:     "character device",
+		tBasicFifo:           "fifo",
+		tBasicSocket:         "socket",
+		tExtendedDirectory:   "extended directory",
+		tExtendedFile:        "extended file",
+		tExtendedSymlink:     "extended symlink",
+		tExtendedBlockDevice: "extended block device",
+		tExtendedCharDevice:  "extended character device",
+		tExtendedFifo:        "extended fifo",
+		tExtendedSocket:      "extended socket",
+	}
+	if name, ok := names[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown type %d", t)
+}
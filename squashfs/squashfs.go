@@ -2,7 +2,6 @@ package squashfs
 
 import (
 	"bytes"
-	"compress/zlib"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -12,6 +11,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
 )
 
@@ -31,8 +31,8 @@ func New(reader *io.SectionReader) (*SquashFS, error) {
 	if superblock.Magic != 0x73717368 {
 		return nil, errors.New("not a squashfs archive, magic bytes dont match")
 	}
-	if superblock.CompressionId != 1 {
-		return nil, unimplemented("compression type other than gzip")
+	if superblock.CompressionId != CompressionGzip && superblock.CompressionId != CompressionZstd {
+		return nil, unimplemented("compression type other than gzip or zstd")
 	}
 	if log2(superblock.BlockSize) != uint32(superblock.BlockLog) {
 		return nil, errors.New("Corrupt archive: BlogLog does not match log2(BlockSize)")
@@ -55,9 +55,76 @@ func New(reader *io.SectionReader) (*SquashFS, error) {
 
 	sqfs.reader = reader
 	sqfs.superblock = superblock
+	// extracting and hashing large files should use all cores
+	sqfs.SetReadAhead(runtime.NumCPU())
 	return &sqfs, nil
 }
 
+// ProbeSuperblock checks whether a plausible squashfs superblock starts at offset off in r,
+// with size bytes available from there on. This is stricter than New(), which just checks the magic.
+// It's meant to find a filesystem in a file that has other things in front of it.
+func ProbeSuperblock(r io.ReaderAt, off, size int64) error {
+	superblock := Superblock{}
+	if err := binary.Read(io.NewSectionReader(r, off, size), binary.LittleEndian, &superblock); err != nil {
+		return err
+	}
+	if err := probeHeader(superblock); err != nil {
+		return err
+	}
+	if superblock.BlockSize < 4096 || superblock.BlockSize > 1<<20 || superblock.BlockSize&(superblock.BlockSize-1) != 0 {
+		return fmt.Errorf("implausible block size %d", superblock.BlockSize)
+	}
+	if log2(superblock.BlockSize) != uint32(superblock.BlockLog) {
+		return errors.New("Corrupt archive: BlogLog does not match log2(BlockSize)")
+	}
+	if superblock.BytesUsed < 96 || superblock.BytesUsed > uint64(size) {
+		return fmt.Errorf("archive claims to be %d bytes, but only %d are available", superblock.BytesUsed, size)
+	}
+	if superblock.InodeTableStart >= superblock.BytesUsed ||
+		superblock.DirectoryTableStart >= superblock.BytesUsed ||
+		superblock.InodeTableStart > superblock.DirectoryTableStart ||
+		superblock.IdTableStart >= superblock.BytesUsed {
+		return errors.New("table offsets point outside of the archive")
+	}
+	return nil
+}
+
+// ProbeHeader only checks that a squashfs 4.0 superblock starts at offset off in r.
+// Unlike ProbeSuperblock() it accepts truncated and damaged filesystems,
+// for when a filesystem is expected at off, so that New() and Fsck() can tell what's wrong with it.
+func ProbeHeader(r io.ReaderAt, off int64) error {
+	superblock := Superblock{}
+	if err := binary.Read(io.NewSectionReader(r, off, int64(binary.Size(superblock))), binary.LittleEndian, &superblock); err != nil {
+		return err
+	}
+	return probeHeader(superblock)
+}
+
+func probeHeader(superblock Superblock) error {
+	if superblock.Magic != 0x73717368 {
+		return errors.New("not a squashfs archive, magic bytes dont match")
+	}
+	if superblock.VersionMajor != 4 || superblock.VersionMinor != 0 {
+		return fmt.Errorf("SquashFS archive is not version 4.0, is: %d.%d", superblock.VersionMajor, superblock.VersionMinor)
+	}
+	return nil
+}
+
+// SetReadAhead makes reading files decompress up to n of the following blocks
+// in parallel while the current one is consumed. Blocks are still returned in order.
+// n is also the number of blocks decompressed at the same time across all open files.
+// New() sets it to the number of CPUs. 0 disables read-ahead, blocks are then decompressed
+// one at a time on the goroutine calling Read().
+//
+// SetReadAhead must not be called while files are being read.
+func (s *SquashFS) SetReadAhead(n int) {
+	if n < 0 {
+		n = 0
+	}
+	s.readAhead = n
+	s.workers = make(chan struct{}, n)
+}
+
 func log2(num uint32) uint32 {
 	var n uint32
 
@@ -111,7 +178,8 @@ func (s *SquashFS) Open(name string) (fs.File, error) {
 				}
 				return s.Open(target)
 			case Directory:
-				return node, nil
+				node.pointingEntry = entry
+				return &node, nil
 			default:
 				return nil, unimplemented(fmt.Sprintf("expected file to open() to be BasicFile or BasicSymlink, is %T", iNode))
 			}
@@ -119,6 +187,8 @@ func (s *SquashFS) Open(name string) (fs.File, error) {
 		}
 	}
 
+	retErr.Path = name
+	retErr.Err = fs.ErrNotExist
 	return nil, &retErr
 }
 func resolveDirectory(s *SquashFS, dirname string) (Directory, error) {
@@ -131,8 +201,13 @@ func resolveDirectory(s *SquashFS, dirname string) (Directory, error) {
 	parent = dir.entries[0] // "." of rootDir()
 
 	for _, f := range pathFragments {
+		if f == "" {
+			continue
+		}
+		found := false
 		for _, entry := range dir.entries {
 			if entry.name == f {
+				found = true
 				_, dirInode, err := s.readInode(uint64(entry.InodeNumber), uint64(entry.Offset), uint64(entry.Start))
 				if err != nil {
 					return dir, err
@@ -154,8 +229,12 @@ func resolveDirectory(s *SquashFS, dirname string) (Directory, error) {
 					return dir, &retErr
 				}
 				dir.entries = append(dirList, tmpDir.entries...)
+				break
 			}
 		}
+		if !found {
+			return dir, &fs.PathError{Op: "open", Path: dirname, Err: fs.ErrNotExist}
+		}
 	}
 	return dir, nil
 }
@@ -202,14 +281,40 @@ func (s *SquashFS) ReadDir(name string) ([]fs.DirEntry, error) {
 }
 
 func (s *SquashFS) readInode(inodeRef uint64, offset uint64, start uint64) (InodeHeader, any, error) {
-	inodeHeader := InodeHeader{}
-	superblock := s.superblock
-
-	blockbuf, err := newBlockReader(s, superblock.InodeTableStart+start, offset)
+	inodeHeader, inode, err := s.readRawInode(start, offset)
 	if err != nil {
 		return inodeHeader, nil, err
 	}
 
+	switch dir := inode.(type) {
+	case BasicDirectory:
+		de, err := readDirectoryTable(s, dir, dir.BlockStart, dir.BlockOffset, uint32(dir.FileSize))
+		return inodeHeader, de, err
+	case ExtendedDirectory:
+		de, err := readDirectoryTable(s, dir, dir.BlockStart, dir.BlockOffset, dir.FileSize)
+		return inodeHeader, de, err
+	}
+
+	return inodeHeader, inode, nil
+}
+
+// readRawInode reads the inode at start/offset in the inode table.
+// Unlike readInode, directories are returned as BasicDirectory/ExtendedDirectory
+// and their entries are not looked up in the directory table.
+func (s *SquashFS) readRawInode(start uint64, offset uint64) (InodeHeader, any, error) {
+	blockbuf, err := newBlockReader(s, s.superblock.InodeTableStart+start, offset)
+	if err != nil {
+		return InodeHeader{}, nil, err
+	}
+	return readInodeFrom(blockbuf, s.superblock.BlockSize)
+}
+
+// readInodeFrom parses a single inode, header included, from blockbuf.
+// blockbuf is left positioned right after the inode, so this can also be used
+// to walk the inode table sequentially.
+func readInodeFrom(blockbuf io.Reader, blockSize uint32) (InodeHeader, any, error) {
+	inodeHeader := InodeHeader{}
+
 	if err := binary.Read(blockbuf, binary.LittleEndian, &inodeHeader); err != nil {
 		return inodeHeader, nil, err
 	}
@@ -221,8 +326,7 @@ func (s *SquashFS) readInode(inodeRef uint64, offset uint64, start uint64) (Inod
 			return inodeHeader, nil, err
 		}
 
-		de, err := readDirectoryTable(s, dir, dir.BlockStart, dir.BlockOffset, uint32(dir.FileSize))
-		return inodeHeader, de, err
+		return inodeHeader, dir, nil
 	case tBasicFile:
 		bfile := BasicFile{}
 		if err := binary.Read(blockbuf, binary.LittleEndian, &bfile.BlocksStart); err != nil {
@@ -238,10 +342,10 @@ func (s *SquashFS) readInode(inodeRef uint64, offset uint64, start uint64) (Inod
 			return inodeHeader, nil, err
 		}
 
-		blkSzCount := bfile.FileSize / superblock.BlockSize
+		blkSzCount := bfile.FileSize / blockSize
 
 		if !bfile.endsInFragment() {
-			if bfile.FileSize%superblock.BlockSize != 0 {
+			if bfile.FileSize%blockSize != 0 {
 				blkSzCount++ // round up
 			}
 		}
@@ -310,9 +414,7 @@ func (s *SquashFS) readInode(inodeRef uint64, offset uint64, start uint64) (Inod
 			dir.Index[i].Name = string(str)
 
 		}
-		de, err := readDirectoryTable(s, dir, dir.BlockStart, dir.BlockOffset, dir.FileSize)
-
-		return inodeHeader, de, err
+		return inodeHeader, dir, nil
 
 		// so annoying
 		// i don't know how to dedupe with code with BasicFile
@@ -345,10 +447,10 @@ func (s *SquashFS) readInode(inodeRef uint64, offset uint64, start uint64) (Inod
 			return inodeHeader, nil, err
 		}
 
-		blkSzCount := extfile.FileSize / uint64(superblock.BlockSize)
+		blkSzCount := extfile.FileSize / uint64(blockSize)
 
 		if !extfile.endsInFragment() { // does this file NOT end in a fragment?
-			if extfile.FileSize%uint64(superblock.BlockSize) != 0 {
+			if extfile.FileSize%uint64(blockSize) != 0 {
 				blkSzCount++ // round up
 			}
 		}
@@ -376,6 +478,30 @@ func (s *SquashFS) readInode(inodeRef uint64, offset uint64, start uint64) (Inod
 		}
 		symlink := ExtendedSymlink{HardLinkCount: hardLinkCount, TargetSize: targetSize, TargetPath: string(str), XattrIdx: xattridx}
 		return inodeHeader, symlink, nil
+	case tBasicBlockDevice, tBasicCharDevice:
+		dev := BasicDevice{}
+		if err := binary.Read(blockbuf, binary.LittleEndian, &dev); err != nil {
+			return inodeHeader, nil, err
+		}
+		return inodeHeader, dev, nil
+	case tExtendedBlockDevice, tExtendedCharDevice:
+		dev := ExtendedDevice{}
+		if err := binary.Read(blockbuf, binary.LittleEndian, &dev); err != nil {
+			return inodeHeader, nil, err
+		}
+		return inodeHeader, dev, nil
+	case tBasicFifo, tBasicSocket:
+		ipc := BasicIPC{}
+		if err := binary.Read(blockbuf, binary.LittleEndian, &ipc); err != nil {
+			return inodeHeader, nil, err
+		}
+		return inodeHeader, ipc, nil
+	case tExtendedFifo, tExtendedSocket:
+		ipc := ExtendedIPC{}
+		if err := binary.Read(blockbuf, binary.LittleEndian, &ipc); err != nil {
+			return inodeHeader, nil, err
+		}
+		return inodeHeader, ipc, nil
 	default:
 		return inodeHeader, nil, unimplemented(fmt.Sprintf("Unhandled inode type: %d\n", inodeHeader.InodeType))
 	}
@@ -395,6 +521,13 @@ func readDirectoryTable[T BasicDirectory | ExtendedDirectory](
 	directories := make([]DirectoryEntry, 0)
 	dirr := Directory{}
 
+	// empty directories only consist of the virtual "." and ".." entries
+	// and have nothing at all in the directory table
+	if fileSize <= 3 {
+		dirr.entries = directories
+		return dirr, nil
+	}
+
 	blockbuf, err := newBlockReader(s, superblock.DirectoryTableStart+uint64(blockstart), uint64(blockoffs))
 	if err != nil {
 		return dirr, err
@@ -407,7 +540,9 @@ func readDirectoryTable[T BasicDirectory | ExtendedDirectory](
 	for {
 		//len1 := blockbuf.Len()
 		dirHeader := DirectoryHeader{}
-		err = binary.Read(blockbuf, binary.LittleEndian, &dirHeader)
+		if err := binary.Read(blockbuf, binary.LittleEndian, &dirHeader); err != nil {
+			return Directory{}, err
+		}
 		dirr.header = dirHeader
 
 		for i := 0; i < int(dirHeader.Count+1); i++ {
@@ -458,6 +593,9 @@ type blockReader struct {
 	datablock []byte
 	s         *SquashFS
 	readCount int
+
+	blockStart uint64 // on disk offset of the block currently in datablock
+	blockLen   int    // uncompressed size of that block
 }
 
 func newBlockReader(s *SquashFS, start, offset uint64) (io.Reader, error) {
@@ -483,6 +621,8 @@ func (br *blockReader) Read(p []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
+		br.blockStart = br.curOffset
+		br.blockLen = len(data)
 		br.curOffset += uint64(disksz)
 		br.datablock = data
 	}
@@ -492,10 +632,19 @@ func (br *blockReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// pos returns where the next byte will be read from, as the on disk offset
+// of its metadata block and the offset inside the uncompressed block.
+func (br *blockReader) pos() (block uint64, offset uint64) {
+	if len(br.datablock) == 0 {
+		return br.curOffset, 0
+	}
+	return br.blockStart, uint64(br.blockLen - len(br.datablock))
+}
+
 func (s *SquashFS) readOneMetaBlock(off uint64) ([]byte, int, error) {
-	r := s.reader
+	// ReadAt instead of Seek+Read, so multiple files can be read concurrently
+	r := io.NewSectionReader(s.reader, int64(off), 2+metadataBlockSize)
 
-	r.Seek(int64(off), io.SeekStart)
 	var header uint16
 	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
 		return nil, 0, err
@@ -512,7 +661,7 @@ func (s *SquashFS) readOneMetaBlock(off uint64) ([]byte, int, error) {
 	}
 
 	if !isUncompressed {
-		inflated, err := uncompress(data)
+		inflated, err := s.uncompress(data)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -523,16 +672,106 @@ func (s *SquashFS) readOneMetaBlock(off uint64) ([]byte, int, error) {
 
 }
 
-func uncompress(b []byte) ([]byte, error) {
-	buf := bytes.NewBuffer(b)
-	r, err := zlib.NewReader(buf)
-	if err != nil {
+// readLookupTable reads count entries of entrySize bytes each from a table stored
+// in metadata blocks, which are located through the list of u64 block offsets at indexStart.
+// The fragment, export and id tables are all stored like this.
+func (s *SquashFS) readLookupTable(indexStart uint64, count int, entrySize int) ([]byte, error) {
+	// count comes from the superblock, which may be corrupt. check it's plausible before allocating anything:
+	// the table is compressed, but not so well that it's bigger than the whole filesystem
+	sz := s.superblock.BytesUsed
+	total := count * entrySize
+	if count < 0 || uint64(total) > sz {
+		return nil, fmt.Errorf("table at 0x%x: %d entries of %d bytes don't fit in a filesystem of %d bytes", indexStart, count, entrySize, sz)
+	}
+	nblocks := (total + metadataBlockSize - 1) / metadataBlockSize
+	if indexStart > sz || uint64(nblocks*8) > sz-indexStart {
+		return nil, fmt.Errorf("table at 0x%x: index of %d blocks extends past the end of the filesystem", indexStart, nblocks)
+	}
+
+	index := make([]uint64, nblocks)
+	indexReader := io.NewSectionReader(s.reader, int64(indexStart), int64(nblocks*8))
+	if err := binary.Read(indexReader, binary.LittleEndian, &index); err != nil {
 		return nil, err
 	}
-	var res bytes.Buffer
-	_, err = res.ReadFrom(r)
+
+	table := make([]byte, 0, total)
+	for _, off := range index {
+		block, _, err := s.readOneMetaBlock(off)
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, block...)
+	}
+	if len(table) < total {
+		return nil, fmt.Errorf("table at 0x%x is too short, expected %d bytes, got %d", indexStart, total, len(table))
+	}
+	return table[:total], nil
+}
+
+// lookupId resolves a uid/gid index from an inode through the id table
+func (s *SquashFS) lookupId(idx uint16) (uint32, error) {
+	s.idsOnce.Do(func() {
+		table, err := s.readLookupTable(s.superblock.IdTableStart, int(s.superblock.IdCount), 4)
+		if err != nil {
+			s.idsErr = fmt.Errorf("reading id table: %w", err)
+			return
+		}
+		s.ids = make([]uint32, s.superblock.IdCount)
+		for i := range s.ids {
+			s.ids[i] = binary.LittleEndian.Uint32(table[i*4:])
+		}
+	})
+	if s.idsErr != nil {
+		return 0, s.idsErr
+	}
+	if int(idx) >= len(s.ids) {
+		return 0, fmt.Errorf("id index %d out of range, filesystem only has %d ids", idx, len(s.ids))
+	}
+	return s.ids[idx], nil
+}
+
+// readFragmentEntry looks up the location of fragment block idx in the fragment table
+func (s *SquashFS) readFragmentEntry(idx uint32) (FragmentBlockEntry, error) {
+	fblock := FragmentBlockEntry{}
+	if idx >= s.superblock.FragmentEntryCount {
+		return fblock, fmt.Errorf("fragment index %d out of range, filesystem only has %d fragments", idx, s.superblock.FragmentEntryCount)
+	}
+
+	// fragment entries are 16 bytes, so 512 of them fit into one metadata block
+	var metablockoffset uint64
+	indexReader := io.NewSectionReader(s.reader, int64(s.superblock.FragmentTableStart)+int64(idx/512)*8, 8)
+	if err := binary.Read(indexReader, binary.LittleEndian, &metablockoffset); err != nil {
+		return fblock, err
+	}
+
+	block, _, err := s.readOneMetaBlock(metablockoffset)
 	if err != nil {
+		return fblock, err
+	}
+	boffset := (idx % 512) * 16
+	if int(boffset)+16 > len(block) {
+		return fblock, fmt.Errorf("fragment table entry %d is out of bounds", idx)
+	}
+	if err := binary.Read(bytes.NewReader(block[boffset:]), binary.LittleEndian, &fblock); err != nil {
+		return fblock, err
+	}
+	return fblock, nil
+}
+
+// readDataBlock reads a data or fragment block of the given size, as stored in a
+// file inodes block list or in the fragment table, and decompresses it if needed.
+// Sparse blocks (size 0) aren't stored at all and come back as expectedSize zero bytes.
+func (s *SquashFS) readDataBlock(start int64, size uint32, expectedSize int) ([]byte, error) {
+	if size == 0 {
+		return make([]byte, expectedSize), nil
+	}
+
+	block := make([]byte, size&^blockUncompressed)
+	if _, err := s.reader.ReadAt(block, start); err != nil {
 		return nil, err
 	}
-	return res.Bytes(), nil
+	if size&blockUncompressed != 0 {
+		return block, nil
+	}
+	return s.uncompress(block)
 }
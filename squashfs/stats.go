@@ -0,0 +1,298 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Superblock returns a copy of the filesystems superblock
+func (s *SquashFS) Superblock() Superblock {
+	return s.superblock
+}
+
+func (sb Superblock) CompressionName() string {
+	switch sb.CompressionId {
+	case 1:
+		return "gzip"
+	case 2:
+		return "lzma"
+	case 3:
+		return "lzo"
+	case 4:
+		return "xz"
+	case 5:
+		return "lz4"
+	case 6:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown (%d)", sb.CompressionId)
+	}
+}
+
+// FlagNames returns the names of all flags set in the superblock
+func (sb Superblock) FlagNames() []string {
+	names := []struct {
+		flag uint16
+		name string
+	}{
+		{UncompressedInodes, "uncompressed inodes"},
+		{UncompressedData, "uncompressed data"},
+		{Check, "check"},
+		{UncompressedFragments, "uncompressed fragments"},
+		{NoFragments, "no fragments"},
+		{AlwaysFragments, "always fragments"},
+		{Duplicates, "duplicates removed"},
+		{Exportable, "exportable"},
+		{UncompressedXAttrs, "uncompressed xattrs"},
+		{NoXAttrs, "no xattrs"},
+		{CompressorOptions, "compressor options"},
+		{UncompressedIds, "uncompressed ids"},
+	}
+	var ret []string
+	for _, n := range names {
+		if sb.Flags&n.flag == n.flag {
+			ret = append(ret, n.name)
+		}
+	}
+	return ret
+}
+
+func (sb Superblock) CreationTime() time.Time {
+	return time.Unix(int64(sb.ModificationTime), 0)
+}
+
+type FileStats struct {
+	Path string
+	Size uint64
+	// on disk size of the files data blocks. if the file ends in a fragment
+	// its share of the compressed fragment block is estimated, as fragment
+	// blocks are compressed as a whole
+	CompressedSize uint64
+}
+
+type DirStats struct {
+	Path  string
+	Depth int // 0 for the root directory
+	// totals of everything below this directory, recursively
+	Size           uint64
+	CompressedSize uint64
+	Files          int
+}
+
+type Stats struct {
+	Files       int
+	Directories int
+	Symlinks    int
+	Other       int // devices, fifos, sockets
+
+	// sum of the sizes of all files. hard links only count once
+	UncompressedSize uint64
+	// on disk size of all data and fragment blocks. data shared between
+	// files (duplicates) is only counted once
+	CompressedSize uint64
+	// size of the inode, directory, fragment, export, id and xattr tables
+	MetadataSize uint64
+
+	DataBlocks      int
+	SparseBlocks    int
+	FragmentBlocks  int
+	FragmentedFiles int // files with their tail in a fragment block
+
+	DuplicateFiles int    // files sharing their data blocks with another file
+	DuplicateSize  uint64 // uncompressed size of those files
+
+	// every directory, sorted by Size, largest first
+	Dirs []DirStats
+	// the largest files, sorted by Size, largest first
+	LargestFiles []FileStats
+}
+
+// Stats walks the whole filesystem and collects size statistics.
+// nLargest limits how many files are returned in Stats.LargestFiles.
+func (s *SquashFS) Stats(nLargest int) (*Stats, error) {
+	sb := s.superblock
+	stats := &Stats{
+		FragmentBlocks: int(sb.FragmentEntryCount),
+		MetadataSize:   sb.BytesUsed - sb.InodeTableStart,
+	}
+
+	// compressed size of each fragment block, to estimate how much of it belongs to a file tail
+	var fragCompressed []uint64
+	if sb.FragmentEntryCount > 0 {
+		table, err := s.readLookupTable(sb.FragmentTableStart, int(sb.FragmentEntryCount), 16)
+		if err != nil {
+			return nil, fmt.Errorf("reading fragment table: %w", err)
+		}
+		fragCompressed = make([]uint64, sb.FragmentEntryCount)
+		for i := range fragCompressed {
+			fragCompressed[i] = uint64(binary.LittleEndian.Uint32(table[i*16+8:]) &^ blockUncompressed)
+			stats.CompressedSize += fragCompressed[i]
+		}
+	}
+
+	var files []FileStats
+	dirs := make(map[string]*DirStats)
+	seenInodes := make(map[uint32]bool)
+	type dataLocation struct {
+		blocksStart   uint64
+		fragment      uint32
+		fragmentStart uint32
+	}
+	seenData := make(map[dataLocation]bool)
+
+	err := s.walkInodes(func(p string, header InodeHeader, inode any) error {
+		var file SqfsFile
+		switch node := inode.(type) {
+		case BasicDirectory, ExtendedDirectory:
+			stats.Directories++
+			depth := 0
+			if p != "." {
+				depth = strings.Count(p, "/") + 1
+			}
+			dirs[p] = &DirStats{Path: p, Depth: depth}
+			return nil
+		case BasicFile:
+			file = node
+		case ExtendedFile:
+			file = node
+		case BasicSymlink, ExtendedSymlink:
+			stats.Symlinks++
+			return nil
+		default:
+			stats.Other++
+			return nil
+		}
+
+		stats.Files++
+		if seenInodes[header.InodeNumber] {
+			// hard link
+			return nil
+		}
+		seenInodes[header.InodeNumber] = true
+
+		var blocksOnDisk uint64
+		for _, sz := range file.iBlockSizes() {
+			if sz == 0 {
+				stats.SparseBlocks++
+			}
+			blocksOnDisk += uint64(sz &^ blockUncompressed)
+		}
+		stats.DataBlocks += len(file.iBlockSizes())
+
+		fstat := FileStats{Path: p, Size: file.iFileSize(), CompressedSize: blocksOnDisk}
+
+		if file.endsInFragment() {
+			stats.FragmentedFiles++
+			idx := file.iFragmentBlockIndex()
+			if idx < sb.FragmentEntryCount {
+				// we don't know the uncompressed size of the fragment block without
+				// decompressing it, assume it's full
+				tail := fstat.Size % uint64(sb.BlockSize)
+				fstat.CompressedSize += tail * fragCompressed[idx] / uint64(sb.BlockSize)
+			}
+		}
+
+		// mksquashfs dedupes identical files by pointing them at the same data
+		dataKey := dataLocation{file.iBlocksStart(), file.iFragmentBlockIndex(), file.iBlockOffset()}
+		// files that are entirely sparse have no data to share
+		hasData := blocksOnDisk > 0 || file.endsInFragment()
+		if hasData && seenData[dataKey] {
+			stats.DuplicateFiles++
+			stats.DuplicateSize += fstat.Size
+		} else {
+			seenData[dataKey] = true
+			stats.CompressedSize += blocksOnDisk
+		}
+
+		stats.UncompressedSize += fstat.Size
+		files = append(files, fstat)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		for dir := path.Dir(f.Path); ; dir = path.Dir(dir) {
+			if ds, ok := dirs[dir]; ok {
+				ds.Size += f.Size
+				ds.CompressedSize += f.CompressedSize
+				ds.Files++
+			}
+			if dir == "." {
+				break
+			}
+		}
+	}
+
+	for _, ds := range dirs {
+		stats.Dirs = append(stats.Dirs, *ds)
+	}
+	sort.Slice(stats.Dirs, func(i, j int) bool {
+		if stats.Dirs[i].Size == stats.Dirs[j].Size {
+			return stats.Dirs[i].Path < stats.Dirs[j].Path
+		}
+		return stats.Dirs[i].Size > stats.Dirs[j].Size
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Size == files[j].Size {
+			return files[i].Path < files[j].Path
+		}
+		return files[i].Size > files[j].Size
+	})
+	if len(files) > nLargest {
+		files = files[:nLargest]
+	}
+	stats.LargestFiles = files
+
+	return stats, nil
+}
+
+// walkInodes calls fn for every inode reachable from the root directory, depth first,
+// directories before their contents. Directories are passed as BasicDirectory/ExtendedDirectory.
+// Paths are slash separated and relative to the root, which itself is ".".
+func (s *SquashFS) walkInodes(fn func(path string, header InodeHeader, inode any) error) error {
+	visited := make(map[uint64]bool)
+
+	var walk func(p string, ref uint64) error
+	walk = func(p string, ref uint64) error {
+		header, inode, err := s.readRawInode(ref>>16, ref&0xFFFF)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if err := fn(p, header, inode); err != nil {
+			return err
+		}
+
+		var dir Directory
+		switch d := inode.(type) {
+		case BasicDirectory:
+			dir, err = readDirectoryTable(s, d, d.BlockStart, d.BlockOffset, uint32(d.FileSize))
+		case ExtendedDirectory:
+			dir, err = readDirectoryTable(s, d, d.BlockStart, d.BlockOffset, d.FileSize)
+		default:
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if visited[ref] {
+			return fmt.Errorf("%s: directory is linked more than once, filesystem contains a loop", p)
+		}
+		visited[ref] = true
+
+		for _, entry := range dir.entries {
+			if err := walk(path.Join(p, entry.name), uint64(entry.Start)<<16|uint64(entry.Offset)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walk(".", s.superblock.RootInodeRef)
+}
@@ -5,11 +5,21 @@ import (
 	"io"
 	"os"
 	"runtime/debug"
+	"sync"
 )
 
 type SquashFS struct {
 	reader     *io.SectionReader
 	superblock Superblock
+
+	// read-ahead, see SetReadAhead()
+	readAhead int
+	workers   chan struct{}
+
+	// uid/gid table, inodes only store indices into it. read on first use
+	idsOnce sync.Once
+	ids     []uint32
+	idsErr  error
 }
 
 type Superblock struct {
@@ -63,6 +73,13 @@ const (
 	UncompressedIds       = 0x0800
 )
 
+// sizes of data blocks and fragment blocks have this bit set
+// if the block is stored uncompressed
+const blockUncompressed = 1 << 24
+
+// size in bytes of a metadata block before compression
+const metadataBlockSize = 8192
+
 const (
 	tNone = iota
 	tBasicDirectory
@@ -117,6 +134,9 @@ type Directory struct {
 	// inode with different names, and the only way to have a name
 	// is to keep track of which DirectoryEntry pointed to this directory
 	// when the path was resolved
+
+	// how many entries ReadDir(n) already returned
+	readDirPos int
 }
 
 type BasicSymlink struct {
@@ -190,3 +210,24 @@ type ExtendedSymlink struct {
 	TargetPath    string
 	XattrIdx      uint32
 }
+
+type BasicDevice struct {
+	HardLinkCount uint32
+	Device        uint32
+}
+
+type ExtendedDevice struct {
+	HardLinkCount uint32
+	Device        uint32
+	XattrIdx      uint32
+}
+
+// fifos and sockets
+type BasicIPC struct {
+	HardLinkCount uint32
+}
+
+type ExtendedIPC struct {
+	HardLinkCount uint32
+	XattrIdx      uint32
+}
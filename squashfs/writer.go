@@ -0,0 +1,854 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type WriterOptions struct {
+	// CompressionGzip or CompressionZstd, defaults to gzip
+	Compression uint16
+	// size of data blocks, a power of two between 4 KiB and 1 MiB, defaults to 128 KiB
+	BlockSize uint32
+	// if set, every inode and the superblock get this modification time.
+	// otherwise the files times are kept and the superblock gets the newest one.
+	// either way nothing depends on when the image is built
+	ModTime time.Time
+	// make everything owned by root instead of keeping the files uid/gid
+	AllRoot bool
+	// store file tails in their own blocks instead of packing them into fragment blocks
+	NoFragments bool
+	// don't store identical files only once
+	NoDedupe bool
+}
+
+// ReadLinkFS is implemented by file systems that can tell where a symlink points.
+// Symlinks can also be written from file systems that don't implement it, if their
+// fs.FileInfo.Sys() implements SquashInfo, like the ones of this package do.
+type ReadLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// DirFS is like os.DirFS, but also implements ReadLinkFS
+// and doesn't follow symlinks when listing directories
+type DirFS string
+
+func (d DirFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(d)).Open(name)
+}
+
+func (d DirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.ReadDir(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d DirFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Readlink(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// WriteDir writes the directory dir on disk as a squashfs image, see Write()
+func WriteDir(w io.WriteSeeker, dir string, opts WriterOptions) (int64, error) {
+	return Write(w, DirFS(dir), opts)
+}
+
+// Write builds a squashfs 4.0 image of everything in fsys and writes it to w,
+// starting at w's current position. That way it can directly follow
+// e.g. an AppImage runtime. Returns the size of the image, which is padded to 4 KiB.
+//
+// The same input always gives the same image, byte for byte. Hard links are kept
+// for files from disk and from squashfs images, device numbers also for ISO 9660 ones.
+func Write(w io.WriteSeeker, fsys fs.FS, opts WriterOptions) (int64, error) {
+	if opts.Compression == 0 {
+		opts.Compression = CompressionGzip
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = 128 * 1024
+	}
+	if opts.BlockSize < 4096 || opts.BlockSize > 1024*1024 || opts.BlockSize&(opts.BlockSize-1) != 0 {
+		return 0, fmt.Errorf("invalid block size %d, must be a power of two between 4 KiB and 1 MiB", opts.BlockSize)
+	}
+	comp, err := newCompressor(opts.Compression, opts.BlockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	base, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	sw := &sqfsWriter{
+		fsys:    fsys,
+		opts:    opts,
+		comp:    comp,
+		out:     &countingWriter{w: w},
+		workers: runtime.NumCPU(),
+		idIndex: make(map[uint32]uint16),
+		links:   make(map[linkKey]*wnode),
+		dedupe:  make(map[fileKey]fileData),
+	}
+	return sw.write(base)
+}
+
+// a file, directory or whatever else to be written.
+// the whole tree is kept in memory, so the inode numbers are known up front
+type wnode struct {
+	path     string // in fsys
+	name     string
+	mode     fs.FileMode
+	info     fs.FileInfo
+	children []*wnode // sorted by name
+
+	inodeNumber uint32
+	ref         uint64 // where the inode ended up in the inode table
+	// hard links. the first name of an inode, in the order inodes are written, owns it
+	// and counts its names, the others point to it and don't get an inode of their own
+	nlink  uint32
+	linkTo *wnode
+
+	data          fileData // regular files only
+	symlinkTarget string
+}
+
+type fileData struct {
+	size          uint64
+	blocksStart   uint64
+	blockSizes    []uint32
+	fragmentIndex uint32
+	fragmentOffs  uint32
+	sparse        uint64
+}
+
+// files are deduplicated by size and content hash
+type fileKey struct {
+	size uint64
+	hash [sha256.Size]byte
+}
+
+type sqfsWriter struct {
+	fsys    fs.FS
+	opts    WriterOptions
+	comp    compressor
+	out     *countingWriter
+	workers int
+
+	nInodes uint32
+	modTime uint32 // newest inode mtime, for the superblock
+
+	ids     []uint32
+	idIndex map[uint32]uint16
+
+	links map[linkKey]*wnode
+
+	dedupe    map[fileKey]fileData
+	fragBuf   []byte
+	fragments []FragmentBlockEntry
+}
+
+func (sw *sqfsWriter) write(base int64) (int64, error) {
+	rootInfo, err := fs.Stat(sw.fsys, ".")
+	if err != nil {
+		return 0, err
+	}
+	root, err := sw.scan(".", ".", rootInfo)
+	if err != nil {
+		return 0, err
+	}
+	if !root.mode.IsDir() {
+		return 0, errors.New("root of the file system to write is not a directory")
+	}
+	sw.number(root)
+
+	// the superblock needs to know where everything ended up, write it last
+	if _, err := sw.out.Write(make([]byte, binary.Size(Superblock{}))); err != nil {
+		return 0, err
+	}
+
+	if err := sw.writeData(root); err != nil {
+		return 0, err
+	}
+	if err := sw.flushFragment(); err != nil {
+		return 0, err
+	}
+
+	inodes := newMetaWriter(sw.comp)
+	dirs := newMetaWriter(sw.comp)
+	if err := sw.writeInodes(root, sw.nInodes+1, inodes, dirs); err != nil {
+		return 0, err
+	}
+
+	sb := Superblock{
+		Magic:              0x73717368,
+		InodeCount:         sw.nInodes,
+		ModificationTime:   sw.modTime,
+		BlockSize:          sw.opts.BlockSize,
+		FragmentEntryCount: uint32(len(sw.fragments)),
+		CompressionId:      sw.comp.id(),
+		BlockLog:           uint16(log2(sw.opts.BlockSize)),
+		Flags:              NoXAttrs,
+		IdCount:            uint16(len(sw.ids)),
+		VersionMajor:       4,
+		VersionMinor:       0,
+		RootInodeRef:       root.ref,
+		XattrIdTableStart:  ^uint64(0),
+		ExportTableStart:   ^uint64(0),
+	}
+	if !sw.opts.NoDedupe {
+		sb.Flags |= Duplicates
+	}
+	if sw.opts.NoFragments {
+		sb.Flags |= NoFragments
+	}
+	if !sw.opts.ModTime.IsZero() {
+		sb.ModificationTime = clampTime(sw.opts.ModTime)
+	}
+
+	sb.InodeTableStart = uint64(sw.out.n)
+	if _, err := sw.out.Write(inodes.finish()); err != nil {
+		return 0, err
+	}
+	sb.DirectoryTableStart = uint64(sw.out.n)
+	if _, err := sw.out.Write(dirs.finish()); err != nil {
+		return 0, err
+	}
+
+	var fragTable bytes.Buffer
+	for _, frag := range sw.fragments {
+		binary.Write(&fragTable, binary.LittleEndian, frag)
+	}
+	if sb.FragmentTableStart, err = sw.writeLookupTable(fragTable.Bytes()); err != nil {
+		return 0, err
+	}
+
+	var idTable bytes.Buffer
+	binary.Write(&idTable, binary.LittleEndian, sw.ids)
+	if sb.IdTableStart, err = sw.writeLookupTable(idTable.Bytes()); err != nil {
+		return 0, err
+	}
+
+	sb.BytesUsed = uint64(sw.out.n)
+
+	// pad to 4K, as the kernel reads the device in 4K blocks
+	if pad := sw.out.n % 4096; pad != 0 {
+		if _, err := sw.out.Write(make([]byte, 4096-pad)); err != nil {
+			return 0, err
+		}
+	}
+	size := sw.out.n
+
+	if _, err := sw.out.w.Seek(base, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(sw.out.w, binary.LittleEndian, sb); err != nil {
+		return 0, err
+	}
+	if _, err := sw.out.w.Seek(base+size, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// scan reads the directory tree at p into memory.
+// info must not follow symlinks, like the ones from directory listings
+func (sw *sqfsWriter) scan(p, name string, info fs.FileInfo) (*wnode, error) {
+	node := &wnode{path: p, name: name, mode: info.Mode(), info: info}
+
+	switch {
+	case node.mode.IsDir():
+		entries, err := fs.ReadDir(sw.fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			// squashfs.SquashFS lists these too
+			if e.Name() == "." || e.Name() == ".." {
+				continue
+			}
+			if len(e.Name()) > 256 {
+				return nil, fmt.Errorf("%s: file name longer than 256 bytes", path.Join(p, e.Name()))
+			}
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			child, err := sw.scan(path.Join(p, e.Name()), e.Name(), info)
+			if err != nil {
+				return nil, err
+			}
+			node.children = append(node.children, child)
+		}
+		sort.Slice(node.children, func(i, j int) bool {
+			return node.children[i].name < node.children[j].name
+		})
+	case node.mode&fs.ModeSymlink != 0:
+		var err error
+		node.symlinkTarget, err = readLink(sw.fsys, p, info)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func readLink(fsys fs.FS, p string, info fs.FileInfo) (string, error) {
+	if rl, ok := fsys.(ReadLinkFS); ok {
+		return rl.ReadLink(p)
+	}
+	if sq, ok := info.Sys().(SquashInfo); ok {
+		return sq.SymlinkTarget(), nil
+	}
+	return "", &fs.PathError{Op: "readlink", Path: p, Err: errors.New("file system doesn't support reading symlinks")}
+}
+
+// number assigns inode numbers, children before their parent directory.
+// that's also the order the inodes are written in, so the first name of a hard linked inode
+// is written before any directory listing that needs to know where it is
+func (sw *sqfsWriter) number(node *wnode) {
+	for _, child := range node.children {
+		sw.number(child)
+	}
+	if key, ok := hardLinkKey(node.info); ok {
+		if first, ok := sw.links[key]; ok {
+			first.nlink++
+			node.linkTo = first
+			node.inodeNumber = first.inodeNumber
+			return
+		}
+		sw.links[key] = node
+	}
+	sw.nInodes++
+	node.inodeNumber = sw.nInodes
+	node.nlink = 1
+}
+
+func (sw *sqfsWriter) writeData(node *wnode) error {
+	for _, child := range node.children {
+		if err := sw.writeData(child); err != nil {
+			return err
+		}
+	}
+	if !node.mode.IsRegular() || node.linkTo != nil {
+		return nil
+	}
+	data, err := sw.writeFile(node.path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", node.path, err)
+	}
+	node.data = data
+	return nil
+}
+
+func (sw *sqfsWriter) writeFile(p string) (fileData, error) {
+	var key fileKey
+	if !sw.opts.NoDedupe {
+		// hash first, so we know if we need to write anything at all
+		f, err := sw.fsys.Open(p)
+		if err != nil {
+			return fileData{}, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return fileData{}, err
+		}
+		key.size = uint64(n)
+		copy(key.hash[:], h.Sum(nil))
+		if data, ok := sw.dedupe[key]; ok {
+			return data, nil
+		}
+	}
+
+	f, err := sw.fsys.Open(p)
+	if err != nil {
+		return fileData{}, err
+	}
+	defer f.Close()
+
+	blockSize := int(sw.opts.BlockSize)
+	data := fileData{blocksStart: uint64(sw.out.n), fragmentIndex: 0xFFFFFFFF}
+	var tail []byte
+	for eof := false; !eof; {
+		// read a batch of blocks, and compress them in parallel
+		var batch [][]byte
+		for len(batch) < sw.workers {
+			buf := make([]byte, blockSize)
+			n, err := io.ReadFull(f, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return fileData{}, err
+			}
+			data.size += uint64(n)
+			if n == blockSize {
+				batch = append(batch, buf)
+			} else if n > 0 {
+				tail = buf[:n]
+			}
+			if eof {
+				break
+			}
+		}
+		if tail != nil && sw.opts.NoFragments {
+			batch = append(batch, tail)
+			tail = nil
+		}
+
+		blocks, sizes, err := sw.compressBlocks(batch)
+		if err != nil {
+			return fileData{}, err
+		}
+		for i, b := range blocks {
+			if _, err := sw.out.Write(b); err != nil {
+				return fileData{}, err
+			}
+			if sizes[i] == 0 {
+				data.sparse += uint64(len(batch[i]))
+			}
+		}
+		data.blockSizes = append(data.blockSizes, sizes...)
+	}
+
+	if !sw.opts.NoDedupe && data.size != key.size {
+		return fileData{}, errors.New("file changed while reading it")
+	}
+
+	if tail != nil {
+		if len(sw.fragBuf)+len(tail) > blockSize {
+			if err := sw.flushFragment(); err != nil {
+				return fileData{}, err
+			}
+		}
+		data.fragmentIndex = uint32(len(sw.fragments))
+		data.fragmentOffs = uint32(len(sw.fragBuf))
+		sw.fragBuf = append(sw.fragBuf, tail...)
+	}
+
+	if !sw.opts.NoDedupe {
+		sw.dedupe[key] = data
+	}
+	return data, nil
+}
+
+// compressBlocks compresses data blocks concurrently. it returns what to write
+// for each block, and the size to put into the inode's block list.
+// blocks that are all zeros are sparse and not written at all
+func (sw *sqfsWriter) compressBlocks(batch [][]byte) ([][]byte, []uint32, error) {
+	blocks := make([][]byte, len(batch))
+	sizes := make([]uint32, len(batch))
+	errs := make([]error, len(batch))
+
+	var wg sync.WaitGroup
+	for i := range batch {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if isZero(batch[i]) {
+				return
+			}
+			blocks[i], sizes[i], errs[i] = sw.compressBlock(batch[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return blocks, sizes, nil
+}
+
+// compressBlock compresses a data or fragment block, unless that doesn't make it any smaller
+func (sw *sqfsWriter) compressBlock(b []byte) ([]byte, uint32, error) {
+	c, err := sw.comp.compress(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(c) >= len(b) {
+		return b, uint32(len(b)) | blockUncompressed, nil
+	}
+	return c, uint32(len(c)), nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (sw *sqfsWriter) flushFragment() error {
+	if len(sw.fragBuf) == 0 {
+		return nil
+	}
+	block, size, err := sw.compressBlock(sw.fragBuf)
+	if err != nil {
+		return err
+	}
+	sw.fragments = append(sw.fragments, FragmentBlockEntry{Start: uint64(sw.out.n), Size: size})
+	if _, err := sw.out.Write(block); err != nil {
+		return err
+	}
+	sw.fragBuf = nil
+	return nil
+}
+
+// writeInodes writes the inodes, children first, as the directory listing
+// needs to know where their inodes are. the parent directory needs to know
+// where its listing is, so it comes after.
+func (sw *sqfsWriter) writeInodes(node *wnode, parentInode uint32, inodes, dirs *metaWriter) error {
+	for _, child := range node.children {
+		if err := sw.writeInodes(child, node.inodeNumber, inodes, dirs); err != nil {
+			return err
+		}
+	}
+	if node.linkTo != nil {
+		node.ref = node.linkTo.ref
+		return nil
+	}
+
+	header, err := sw.inodeHeader(node)
+	if err != nil {
+		return err
+	}
+
+	var inode bytes.Buffer
+	switch {
+	case node.mode.IsDir():
+		block, offset := dirs.pos()
+		listingSize, err := sw.writeDirectory(node, dirs)
+		if err != nil {
+			return err
+		}
+		nlink := uint32(2)
+		for _, child := range node.children {
+			if child.mode.IsDir() {
+				nlink++
+			}
+		}
+		// the extra 3 bytes are for the virtual "." and ".." entries
+		fileSize := uint32(listingSize) + 3
+		if fileSize <= 0xFFFF {
+			header.InodeType = tBasicDirectory
+			binary.Write(&inode, binary.LittleEndian, header)
+			binary.Write(&inode, binary.LittleEndian, BasicDirectory{
+				BlockStart:        block,
+				HardLinkCount:     nlink,
+				FileSize:          uint16(fileSize),
+				BlockOffset:       offset,
+				ParentInodeNumber: parentInode,
+			})
+		} else {
+			header.InodeType = tExtendedDirectory
+			binary.Write(&inode, binary.LittleEndian, header)
+			binary.Write(&inode, binary.LittleEndian, []uint32{nlink, fileSize, block, parentInode})
+			binary.Write(&inode, binary.LittleEndian, []uint16{0, offset}) // no directory index
+			binary.Write(&inode, binary.LittleEndian, ^uint32(0))          // no xattrs
+		}
+	case node.mode.IsRegular():
+		d := node.data
+		// basic file inodes have no link count
+		if d.blocksStart <= 0xFFFFFFFF && d.size <= 0xFFFFFFFF && node.nlink == 1 {
+			header.InodeType = tBasicFile
+			binary.Write(&inode, binary.LittleEndian, header)
+			binary.Write(&inode, binary.LittleEndian, []uint32{uint32(d.blocksStart), d.fragmentIndex, d.fragmentOffs, uint32(d.size)})
+		} else {
+			header.InodeType = tExtendedFile
+			binary.Write(&inode, binary.LittleEndian, header)
+			binary.Write(&inode, binary.LittleEndian, []uint64{d.blocksStart, d.size, d.sparse})
+			binary.Write(&inode, binary.LittleEndian, []uint32{node.nlink, d.fragmentIndex, d.fragmentOffs, ^uint32(0)})
+		}
+		binary.Write(&inode, binary.LittleEndian, d.blockSizes)
+	case node.mode&fs.ModeSymlink != 0:
+		header.InodeType = tBasicSymlink
+		binary.Write(&inode, binary.LittleEndian, header)
+		binary.Write(&inode, binary.LittleEndian, []uint32{node.nlink, uint32(len(node.symlinkTarget))})
+		inode.WriteString(node.symlinkTarget)
+	case node.mode&fs.ModeDevice != 0:
+		header.InodeType = tBasicBlockDevice
+		if node.mode&fs.ModeCharDevice != 0 {
+			header.InodeType = tBasicCharDevice
+		}
+		binary.Write(&inode, binary.LittleEndian, header)
+		binary.Write(&inode, binary.LittleEndian, BasicDevice{HardLinkCount: node.nlink, Device: deviceNumber(node.info)})
+	case node.mode&fs.ModeNamedPipe != 0:
+		header.InodeType = tBasicFifo
+		binary.Write(&inode, binary.LittleEndian, header)
+		binary.Write(&inode, binary.LittleEndian, BasicIPC{HardLinkCount: node.nlink})
+	case node.mode&fs.ModeSocket != 0:
+		header.InodeType = tBasicSocket
+		binary.Write(&inode, binary.LittleEndian, header)
+		binary.Write(&inode, binary.LittleEndian, BasicIPC{HardLinkCount: node.nlink})
+	default:
+		return fmt.Errorf("%s: unsupported file type %s", node.path, node.mode.Type())
+	}
+
+	block, offset := inodes.pos()
+	node.ref = uint64(block)<<16 | uint64(offset)
+	inodes.Write(inode.Bytes())
+	return nil
+}
+
+func (sw *sqfsWriter) inodeHeader(node *wnode) (InodeHeader, error) {
+	header := InodeHeader{
+		Permissions: fileModeToUnix(node.mode),
+		InodeNumber: node.inodeNumber,
+	}
+
+	mtime := clampTime(node.info.ModTime())
+	if !sw.opts.ModTime.IsZero() {
+		mtime = clampTime(sw.opts.ModTime)
+	}
+	header.ModifiedTime = mtime
+	if mtime > sw.modTime {
+		sw.modTime = mtime
+	}
+
+	var uid, gid uint32
+	if !sw.opts.AllRoot {
+		switch sys := node.info.Sys().(type) {
+		case SquashInfo:
+			uid, gid = sys.Uid(), sys.Gid()
+		case *syscall.Stat_t:
+			uid, gid = sys.Uid, sys.Gid
+		}
+	}
+	var err error
+	if header.UidIdx, err = sw.id(uid); err != nil {
+		return header, err
+	}
+	if header.GidIdx, err = sw.id(gid); err != nil {
+		return header, err
+	}
+	return header, nil
+}
+
+// id returns the index of a uid/gid in the id table
+func (sw *sqfsWriter) id(id uint32) (uint16, error) {
+	if idx, ok := sw.idIndex[id]; ok {
+		return idx, nil
+	}
+	if len(sw.ids) >= 0xFFFF {
+		return 0, errors.New("too many different uids/gids")
+	}
+	idx := uint16(len(sw.ids))
+	sw.ids = append(sw.ids, id)
+	sw.idIndex[id] = idx
+	return idx, nil
+}
+
+// writeDirectory writes the listing of node into the directory table.
+// entries are grouped under headers, which hold the inode metadata block
+// and a base inode number the entries are relative to.
+func (sw *sqfsWriter) writeDirectory(node *wnode, dirs *metaWriter) (int, error) {
+	var listing bytes.Buffer
+	var header DirectoryHeader
+	var headerPos int
+	count := 0
+
+	for _, child := range node.children {
+		start := uint32(child.ref >> 16)
+		delta := int64(child.inodeNumber) - int64(header.InodeNumber)
+		if count == 0 || count == 256 || start != header.Start || delta < -0x8000 || delta > 0x7FFF {
+			if count > 0 {
+				header.Count = uint32(count - 1)
+				binary.LittleEndian.PutUint32(listing.Bytes()[headerPos:], header.Count)
+			}
+			header = DirectoryHeader{Start: start, InodeNumber: child.inodeNumber}
+			headerPos = listing.Len()
+			binary.Write(&listing, binary.LittleEndian, header)
+			count = 0
+			delta = 0
+		}
+
+		binary.Write(&listing, binary.LittleEndian, struct {
+			Offset      uint16
+			InodeOffset int16
+			Type        uint16
+			NameSize    uint16
+		}{uint16(child.ref & 0xFFFF), int16(delta), basicInodeTypeOf(child.mode), uint16(len(child.name) - 1)})
+		listing.WriteString(child.name)
+		count++
+	}
+	if count > 0 {
+		binary.LittleEndian.PutUint32(listing.Bytes()[headerPos:], uint32(count-1))
+	}
+
+	if listing.Len()+3 > 0xFFFFFFFF {
+		return 0, fmt.Errorf("%s: directory too large", node.path)
+	}
+	dirs.Write(listing.Bytes())
+	return listing.Len(), nil
+}
+
+// basicInodeTypeOf is the type stored in directory entries, they always use the basic types
+func basicInodeTypeOf(mode fs.FileMode) uint16 {
+	switch {
+	case mode.IsDir():
+		return tBasicDirectory
+	case mode&fs.ModeSymlink != 0:
+		return tBasicSymlink
+	case mode&fs.ModeCharDevice != 0:
+		return tBasicCharDevice
+	case mode&fs.ModeDevice != 0:
+		return tBasicBlockDevice
+	case mode&fs.ModeNamedPipe != 0:
+		return tBasicFifo
+	case mode&fs.ModeSocket != 0:
+		return tBasicSocket
+	default:
+		return tBasicFile
+	}
+}
+
+// deviceNumber encodes the device number of a device node the way the kernel
+// stores it on disk. works for files from disk and file systems implementing DeviceInfo,
+// everything else gets 0
+func deviceNumber(info fs.FileInfo) uint32 {
+	var major, minor uint32
+	switch sys := info.Sys().(type) {
+	case DeviceInfo:
+		major, minor = sys.DeviceNumber()
+	case *syscall.Stat_t:
+		rdev := uint64(sys.Rdev)
+		major = uint32((rdev>>8)&0xfff | (rdev>>32)&^0xfff)
+		minor = uint32(rdev&0xff | (rdev>>12)&^0xff)
+	}
+	return encodeDevice(major, minor)
+}
+
+// linkKey identifies an inode in the file system being written, to find hard links
+type linkKey struct {
+	dev, ino uint64
+}
+
+// hardLinkKey returns which inode info belongs to, false if that can't be told or it has no other links.
+// works for files from disk and from this package's file system
+func hardLinkKey(info fs.FileInfo) (linkKey, bool) {
+	if info.IsDir() {
+		return linkKey{}, false
+	}
+	switch sys := info.Sys().(type) {
+	case FileInfo:
+		// where the inode is stored identifies it, no device can have that number
+		return linkKey{^uint64(0), uint64(sys.dirEntry.Start)<<16 | uint64(sys.dirEntry.Offset)}, true
+	case *syscall.Stat_t:
+		if sys.Nlink < 2 {
+			return linkKey{}, false
+		}
+		return linkKey{uint64(sys.Dev), uint64(sys.Ino)}, true
+	}
+	return linkKey{}, false
+}
+
+func clampTime(t time.Time) uint32 {
+	unix := t.Unix()
+	if unix < 0 {
+		return 0
+	}
+	if unix > 0xFFFFFFFF {
+		return 0xFFFFFFFF
+	}
+	return uint32(unix)
+}
+
+// writeLookupTable writes table into metadata blocks, followed by the list of
+// their offsets, which is what the superblock points to
+func (sw *sqfsWriter) writeLookupTable(table []byte) (uint64, error) {
+	mw := newMetaWriter(sw.comp)
+	mw.Write(table)
+	start := uint64(sw.out.n)
+	if _, err := sw.out.Write(mw.finish()); err != nil {
+		return 0, err
+	}
+
+	indexStart := uint64(sw.out.n)
+	for _, off := range mw.blocks {
+		if err := binary.Write(sw.out, binary.LittleEndian, start+uint64(off)); err != nil {
+			return 0, err
+		}
+	}
+	return indexStart, nil
+}
+
+// metaWriter packs data into metadata blocks, each 8K before compression
+type metaWriter struct {
+	comp    compressor
+	pending []byte
+	out     bytes.Buffer
+	blocks  []uint32 // offsets of the finished blocks in out
+}
+
+func newMetaWriter(comp compressor) *metaWriter {
+	return &metaWriter{comp: comp}
+}
+
+// pos returns where the next byte written will end up,
+// as offset of its metadata block and offset inside that block
+func (mw *metaWriter) pos() (uint32, uint16) {
+	return uint32(mw.out.Len()), uint16(len(mw.pending))
+}
+
+func (mw *metaWriter) Write(p []byte) (int, error) {
+	mw.pending = append(mw.pending, p...)
+	for len(mw.pending) >= metadataBlockSize {
+		mw.flush(mw.pending[:metadataBlockSize])
+		mw.pending = mw.pending[metadataBlockSize:]
+	}
+	return len(p), nil
+}
+
+func (mw *metaWriter) flush(block []byte) {
+	mw.blocks = append(mw.blocks, uint32(mw.out.Len()))
+	c, err := mw.comp.compress(block)
+	// compressing into memory can't really fail, but if it does, storing it uncompressed is fine too
+	if err != nil || len(c) >= len(block) {
+		binary.Write(&mw.out, binary.LittleEndian, uint16(len(block))|1<<15)
+		mw.out.Write(block)
+		return
+	}
+	binary.Write(&mw.out, binary.LittleEndian, uint16(len(c)))
+	mw.out.Write(c)
+}
+
+func (mw *metaWriter) finish() []byte {
+	if len(mw.pending) > 0 {
+		mw.flush(mw.pending)
+		mw.pending = nil
+	}
+	return mw.out.Bytes()
+}
+
+type countingWriter struct {
+	w io.WriteSeeker
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,98 @@
+package trust
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lawl/ayy/appimage"
+	"golang.org/x/crypto/openpgp"
+)
+
+// ErrUntrusted is returned if an AppImage isn't signed by the key trusted for its ID
+var ErrUntrusted = errors.New("AppImage is not signed by the trusted key")
+
+// Signer verifies ai's signatures and returns the key that made them, nil if ai isn't signed.
+// OpenPGP signatures may also be made by an imported key, see Import().
+// If ai carries both an OpenPGP and a minisign signature, both must verify, and the OpenPGP key is returned,
+// with the minisign key in Also().
+// This hashes the whole file, so do it before locking the store with Update().
+func Signer(ai *appimage.AppImage) (*Key, error) {
+	var key *Key
+	if ai.HasSignature() {
+		keyring, err := LoadKeyring()
+		if err != nil {
+			return nil, err
+		}
+		signer, ok, err := ai.SignatureWithKeyring(keyring)
+		if err != nil || !ok {
+			return nil, fmt.Errorf("%w: AppImage with ID '%s' has a signature that does not verify, WILL NOT PROCEED: %v", ErrUntrusted, ai.ID(), err)
+		}
+		key = KeyFromEntity(&signer)
+		// .sig_key may carry more than the signing key, e.g. the old key of a rotation
+		if rawkey, err := ai.ELFSectionAsString(".sig_key"); err == nil {
+			key.keyring, _ = openpgp.ReadArmoredKeyRing(strings.NewReader(rawkey))
+		}
+	}
+	if ai.HasMinisign() {
+		signer, ok, err := ai.Minisign()
+		if err != nil || !ok {
+			return nil, fmt.Errorf("%w: AppImage with ID '%s' has a minisign signature that does not verify, WILL NOT PROCEED: %v", ErrUntrusted, ai.ID(), err)
+		}
+		key = key.with(KeyFromMinisign(signer))
+	}
+	return key, nil
+}
+
+// Check verifies that key, as returned by Signer(), is the key trusted for id.
+// Any key is fine if the ID has no trusted key yet, use Remember() to trust it once the AppImage is installed.
+func (s *Store) Check(id appimage.AppImageID, key *Key) error {
+	trusted := s.Get(id)
+	if trusted == nil {
+		return nil
+	}
+	if key == nil {
+		return fmt.Errorf("%w: '%s' was signed by %s when first seen, but this AppImage is not signed, WILL NOT PROCEED", ErrUntrusted, id, trusted.Fingerprint)
+	}
+	for _, fp := range key.Fingerprints() {
+		if fp == trusted.Fingerprint {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: '%s' is trusted with key %s, but this AppImage is signed by %s, which isn't certified by the trusted key, WILL NOT PROCEED. If the key change is legitimate, use 'ayy trust pin'", ErrUntrusted, id, trusted.Fingerprint, strings.Join(key.Fingerprints(), " and "))
+}
+
+// Remember trusts key for id, unless a key is already trusted for it
+func (s *Store) Remember(id appimage.AppImageID, key *Key) {
+	if key == nil || s.Get(id) != nil {
+		return
+	}
+	k := *key
+	k.also = nil
+	s.Keys[id] = &k
+}
+
+// FileSigner is like Signer(), but also verifies the minisign signature and the Sigstore bundle next to
+// the AppImage at path, if any
+func FileSigner(ai *appimage.AppImage, path string) (*Key, error) {
+	key, err := Signer(ai)
+	if err != nil {
+		return nil, err
+	}
+	store, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	key, err = store.VerifySidecar(ai, path+MinisigSuffix, key)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := BundleSigner(path)
+	if err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		key = key.with(identity)
+	}
+	return key, nil
+}
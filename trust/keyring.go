@@ -0,0 +1,130 @@
+package trust
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/lawl/ayy/xdg"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// the keyring holds OpenPGP keys the user imported, e.g. from their GnuPG keyring.
+// they verify signatures even if the AppImage doesn't embed them, and count as trusted,
+// not just as trusted on first use. the trust store still decides which key may sign an ID.
+
+// KeyringPath returns where imported keys are saved
+func KeyringPath() string {
+	return filepath.Join(xdg.Get(xdg.STATE_HOME), "ayy", "keyring.asc")
+}
+
+// LoadKeyring reads the imported keys. A keyring that doesn't exist yet is empty.
+func LoadKeyring() (openpgp.EntityList, error) {
+	keys, err := ReadKeys(KeyringPath())
+	if err != nil {
+		return nil, fmt.Errorf("keyring '%s' is damaged: %w", KeyringPath(), err)
+	}
+	return keys, nil
+}
+
+// IsImported returns whether the key with fingerprint was imported
+func IsImported(fingerprint string) (bool, error) {
+	keys, err := LoadKeyring()
+	if err != nil {
+		return false, err
+	}
+	return findKey(keys, fingerprint) != nil, nil
+}
+
+// Import adds keys to the keyring. Keys that were imported before are replaced, to pick up
+// new certifications and expiry dates. Returns the keys that weren't imported before.
+func Import(keys openpgp.EntityList) ([]*Key, error) {
+	var added []*Key
+	err := locked(func() error {
+		keyring, err := LoadKeyring()
+		if err != nil {
+			return err
+		}
+		for _, e := range keys {
+			k := KeyFromEntity(e)
+			replaced := false
+			for i, old := range keyring {
+				if fmt.Sprintf("%X", old.PrimaryKey.Fingerprint[:]) == k.Fingerprint {
+					keyring[i], replaced = e, true
+				}
+			}
+			if !replaced {
+				keyring = append(keyring, e)
+				added = append(added, k)
+			}
+		}
+
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		if err != nil {
+			return err
+		}
+		for _, e := range keyring {
+			if err := e.Serialize(w); err != nil {
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		tmp := KeyringPath() + ".tmp"
+		if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, KeyringPath())
+	})
+	return added, err
+}
+
+// ReadGnuPG exports keys from the user's GnuPG keyring, by running gpg.
+// Without ids, that's every key GnuPG considers fully valid, because the user or someone they trust certified it.
+func ReadGnuPG(ids []string) (openpgp.EntityList, error) {
+	list := exec.Command("gpg", append([]string{"--batch", "--with-colons", "--list-keys", "--"}, ids...)...)
+	list.Stderr = os.Stderr
+	out, err := list.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing GnuPG keys: %w", err)
+	}
+
+	// pub:<validity>:... is followed by fpr:::::::::<fingerprint>:
+	var fingerprints []string
+	valid := false
+	inPub := false
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), ":")
+		switch fields[0] {
+		case "pub":
+			inPub = true
+			valid = len(ids) > 0 || (len(fields) > 1 && (fields[1] == "f" || fields[1] == "u"))
+		case "fpr":
+			if inPub && valid && len(fields) > 9 {
+				fingerprints = append(fingerprints, fields[9])
+			}
+			inPub = false
+		default:
+			inPub = false
+		}
+	}
+	if len(fingerprints) == 0 {
+		return nil, nil
+	}
+
+	export := exec.Command("gpg", append([]string{"--batch", "--export", "--"}, fingerprints...)...)
+	export.Stderr = os.Stderr
+	out, err = export.Output()
+	if err != nil {
+		return nil, fmt.Errorf("exporting GnuPG keys: %w", err)
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(out))
+}
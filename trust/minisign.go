@@ -0,0 +1,63 @@
+package trust
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lawl/ayy/appimage"
+)
+
+// MinisigSuffix is appended to an AppImage's path, or its download URL, to find
+// a minisign signature over the whole file next to it
+const MinisigSuffix = ".minisig"
+
+// KeyFromMinisign creates a Key for a minisign public key
+func KeyFromMinisign(k *appimage.MinisignKey) *Key {
+	return &Key{
+		Scheme:      SchemeMinisign,
+		Fingerprint: k.IDString(),
+		KeyID:       k.IDString(),
+		FirstSeen:   time.Now().UTC(),
+		PublicKey:   k.String(),
+	}
+}
+
+// VerifySidecar verifies the minisign signature in sigPath, which covers all of ai, and adds the key that
+// made it to key. The key to verify with is the minisign public key embedded in ai, or the one trusted
+// for ai's ID. A signature by a key we know nothing about proves nothing and is ignored.
+// Returns key as is if there is no sigPath.
+func (s *Store) VerifySidecar(ai *appimage.AppImage, sigPath string, key *Key) (*Key, error) {
+	raw, err := os.ReadFile(sigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sig, err := appimage.ParseMinisignSignature(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", sigPath, err)
+	}
+
+	var candidates []*appimage.MinisignKey
+	if embedded, err := ai.MinisignKey(); err == nil {
+		candidates = append(candidates, embedded)
+	}
+	if trusted := s.Get(ai.ID()); trusted != nil && trusted.Scheme == SchemeMinisign {
+		if pk, err := appimage.ParseMinisignKey(trusted.PublicKey); err == nil {
+			candidates = append(candidates, pk)
+		}
+	}
+	for _, pk := range candidates {
+		if pk.KeyID != sig.KeyID {
+			continue
+		}
+		if err := ai.VerifyMinisignFile(sig, pk); err != nil {
+			return nil, fmt.Errorf("%w: '%s' does not verify, WILL NOT PROCEED: %v", ErrUntrusted, sigPath, err)
+		}
+		return key.with(KeyFromMinisign(pk)), nil
+	}
+	return key, nil
+}
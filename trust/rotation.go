@@ -0,0 +1,139 @@
+package trust
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lawl/ayy/appimage"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// a vendor rotates their key by certifying the new key with the old one, e.g.
+//
+//	gpg --default-key OLD --sign-key NEW
+//
+// and shipping that, either in the AppImage's .sig_key next to the new key,
+// or as a separate file next to the AppImage, see RotationSuffix
+
+// RotationSuffix is appended to an AppImage's path, or its download URL, to find
+// the rotation proof shipped next to it: the new public key, certified by the old one
+const RotationSuffix = ".rotation.asc"
+
+// Rotation records that the key trusted for an ID was replaced by a key it certified
+type Rotation struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+	// where the certification was found
+	Proof string `json:"proof"`
+}
+
+func (r Rotation) String() string {
+	return fmt.Sprintf("signing key changed from %s to %s, the new key is certified by the old one (%s)", r.From, r.To, r.Proof)
+}
+
+// ReadKeys reads armored or binary public keys from path.
+// Returns nil, nil if path doesn't exist.
+func ReadKeys(path string) (openpgp.EntityList, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+	if err != nil {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(buf))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading keys from '%s': %w", path, err)
+	}
+	return keys, nil
+}
+
+// certifiedBy returns whether any identity of newKey carries a valid certification by oldKey
+func certifiedBy(newKey, oldKey *openpgp.Entity) bool {
+	now := time.Now()
+	for name, ident := range newKey.Identities {
+		for _, sig := range ident.Signatures {
+			if sig.IssuerKeyId == nil || *sig.IssuerKeyId != oldKey.PrimaryKey.KeyId {
+				continue
+			}
+			switch sig.SigType {
+			case packet.SigTypeGenericCert, packet.SigTypePersonaCert, packet.SigTypeCasualCert, packet.SigTypePositiveCert:
+			default:
+				continue
+			}
+			if sig.SigLifetimeSecs != nil && *sig.SigLifetimeSecs != 0 &&
+				now.After(sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs)*time.Second)) {
+				continue
+			}
+			if oldKey.PrimaryKey.VerifyUserIdSignature(name, newKey.PrimaryKey, sig) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func findKey(keys openpgp.EntityList, fingerprint string) *openpgp.Entity {
+	for _, e := range keys {
+		if fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]) == fingerprint {
+			return e
+		}
+	}
+	return nil
+}
+
+// Rotate replaces the key trusted for id with key, as returned by Signer(), if key was certified by the
+// trusted key. The certification is looked for in the keyring key came with, and in proof, which may be nil.
+// Returns nil, nil if there is no certification at all.
+func (s *Store) Rotate(id appimage.AppImageID, key *Key, proof openpgp.EntityList, proofName string) (*Rotation, error) {
+	trusted := s.Get(id)
+	if trusted == nil || key == nil || !key.isOpenPGP() || !trusted.isOpenPGP() {
+		return nil, nil
+	}
+
+	// the old public key from the store, or, for keys pinned by fingerprint, shipped along
+	var candidates openpgp.EntityList
+	if trusted.PublicKey != "" {
+		stored, err := openpgp.ReadArmoredKeyRing(strings.NewReader(trusted.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("trusted key for '%s' is damaged: %w", id, err)
+		}
+		candidates = append(candidates, stored...)
+	}
+	candidates = append(candidates, key.keyring...)
+	candidates = append(candidates, proof...)
+	oldKey := findKey(candidates, trusted.Fingerprint)
+	if oldKey == nil {
+		return nil, nil
+	}
+
+	// the new key as found in the AppImage, or the copy in the proof, carries the certification
+	sources := []struct {
+		name string
+		keys openpgp.EntityList
+	}{
+		{".sig_key", key.keyring},
+		{proofName, proof},
+	}
+	for _, src := range sources {
+		newKey := findKey(src.keys, key.Fingerprint)
+		if newKey == nil || !certifiedBy(newKey, oldKey) {
+			continue
+		}
+		r := Rotation{From: trusted.Fingerprint, To: key.Fingerprint, At: time.Now().UTC(), Proof: src.name}
+		k := *key
+		k.Rotations = append(append([]Rotation{}, trusted.Rotations...), r)
+		s.Keys[id] = &k
+		return &r, nil
+	}
+	return nil, nil
+}
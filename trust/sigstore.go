@@ -0,0 +1,51 @@
+package trust
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lawl/ayy/sigstore"
+)
+
+// KeyFromSigstore creates a Key for the identity that signed a Sigstore bundle
+func KeyFromSigstore(id *sigstore.Identity) *Key {
+	// a CI workflow's identity ends in the ref it ran for, e.g. @refs/tags/v1.2,
+	// which changes every release. the workflow itself is what we trust.
+	subject := id.Subject
+	if i := strings.Index(subject, "@refs/"); i > 0 && strings.Contains(subject, "://") {
+		subject = subject[:i]
+	}
+	return &Key{
+		Scheme:      SchemeSigstore,
+		Fingerprint: fmt.Sprintf("%s (%s)", subject, id.Issuer),
+		Identities:  []string{id.Subject},
+		Issuer:      id.Issuer,
+		FirstSeen:   time.Now().UTC(),
+	}
+}
+
+// BundleSigner verifies the Sigstore bundle next to the AppImage at path, and returns the identity that signed it.
+// Returns nil, nil if there is no bundle, or no trusted root to verify it with.
+func BundleSigner(path string) (*Key, error) {
+	bundlePath := path + sigstore.BundleSuffix
+	b, err := sigstore.ReadBundle(bundlePath)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	root, err := sigstore.LoadTrustedRoot()
+	if err != nil || root == nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	id, err := root.Verify(b, f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: '%s' does not verify, WILL NOT PROCEED: %v", ErrUntrusted, bundlePath, err)
+	}
+	return KeyFromSigstore(id), nil
+}
@@ -0,0 +1,241 @@
+package trust
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lawl/ayy/appimage"
+	"github.com/lawl/ayy/xdg"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// the trust store remembers which key signed an AppImage ID the first time we saw it,
+// so a different key is refused even if the previously installed file is long gone
+
+// signature schemes
+const (
+	SchemeOpenPGP  = "openpgp"
+	SchemeMinisign = "minisign"
+	SchemeSigstore = "sigstore"
+)
+
+// Key is a signing key trusted for an AppImage ID
+type Key struct {
+	// SchemeOpenPGP, SchemeMinisign or SchemeSigstore, empty is OpenPGP too
+	Scheme string `json:"scheme,omitempty"`
+	// for minisign, that's the key ID. for Sigstore, the certificate's identity and issuer.
+	Fingerprint string    `json:"fingerprint"`
+	KeyID       string    `json:"key_id"`
+	Identities  []string  `json:"identities,omitempty"`
+	FirstSeen   time.Time `json:"first_seen"`
+	// the OIDC issuer of a Sigstore identity
+	Issuer string `json:"issuer,omitempty"`
+	// set explicitly by the user, as opposed to learned on first use
+	Pinned bool `json:"pinned,omitempty"`
+	// armored, needed to check the certification when the key is rotated.
+	// empty for keys pinned by fingerprint. base64 for minisign.
+	PublicKey string `json:"public_key,omitempty"`
+	// the keys trusted for the ID before this one
+	Rotations []Rotation `json:"rotations,omitempty"`
+
+	// the keyring the key came with, if read from an AppImage
+	keyring openpgp.EntityList
+	// further keys that signed the same AppImage, with another scheme
+	also []*Key
+}
+
+// SchemeName returns the signature scheme, for display
+func (k *Key) SchemeName() string {
+	switch k.Scheme {
+	case SchemeMinisign:
+		return "minisign"
+	case SchemeSigstore:
+		return "Sigstore"
+	}
+	return "OpenPGP"
+}
+
+func (k *Key) isOpenPGP() bool {
+	return k.Scheme == "" || k.Scheme == SchemeOpenPGP
+}
+
+// All returns the key and the keys in Also(). Nil if k is nil.
+func (k *Key) All() []*Key {
+	if k == nil {
+		return nil
+	}
+	return append([]*Key{k}, k.also...)
+}
+
+// Fingerprints returns the fingerprints of All()
+func (k *Key) Fingerprints() []string {
+	var fps []string
+	for _, a := range k.All() {
+		fps = append(fps, a.Fingerprint)
+	}
+	return fps
+}
+
+// Also returns the keys that signed the same AppImage with another scheme
+func (k *Key) Also() []*Key {
+	return k.also
+}
+
+// with adds other to the keys that signed the same AppImage. k may be nil.
+func (k *Key) with(other *Key) *Key {
+	if k == nil {
+		return other
+	}
+	c := *k
+	c.also = append(append([]*Key{}, k.also...), other)
+	return &c
+}
+
+// Store maps AppImage IDs to the key trusted for them
+type Store struct {
+	Keys map[appimage.AppImageID]*Key `json:"keys"`
+}
+
+// Entry is a Store entry, for listing
+type Entry struct {
+	ID appimage.AppImageID
+	*Key
+}
+
+// Path returns where the trust store is saved
+func Path() string {
+	return filepath.Join(xdg.Get(xdg.STATE_HOME), "ayy", "trust.json")
+}
+
+// KeyFromEntity creates a Key for the primary key of e
+func KeyFromEntity(e *openpgp.Entity) *Key {
+	k := Key{
+		Scheme:      SchemeOpenPGP,
+		Fingerprint: fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:]),
+		KeyID:       e.PrimaryKey.KeyIdString(),
+		FirstSeen:   time.Now().UTC(),
+	}
+	for name := range e.Identities {
+		k.Identities = append(k.Identities, name)
+	}
+	sort.Strings(k.Identities)
+
+	var pub bytes.Buffer
+	if w, err := armor.Encode(&pub, openpgp.PublicKeyType, nil); err == nil {
+		if e.Serialize(w) == nil && w.Close() == nil {
+			k.PublicKey = pub.String()
+		}
+	}
+	return &k
+}
+
+// Load reads the trust store. A store that doesn't exist yet is empty.
+func Load() (*Store, error) {
+	s := Store{Keys: make(map[appimage.AppImageID]*Key)}
+	buf, err := os.ReadFile(Path())
+	if errors.Is(err, os.ErrNotExist) {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, fmt.Errorf("trust store '%s' is damaged: %w", Path(), err)
+	}
+	if s.Keys == nil {
+		s.Keys = make(map[appimage.AppImageID]*Key)
+	}
+	return &s, nil
+}
+
+func (s *Store) save() error {
+	buf, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	p := Path()
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// parallel upgrades all want to write the store
+var mu sync.Mutex
+
+// Update loads the store, calls fn and saves the store if fn didn't return an error.
+// Other ayy processes are locked out while fn runs.
+func Update(fn func(s *Store) error) error {
+	return locked(func() error {
+		s, err := Load()
+		if err != nil {
+			return err
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+		return s.save()
+	})
+}
+
+// locked calls fn with the trust store and the keyring locked
+func locked(fn func() error) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(Path()), 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(Path()+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("locking trust store: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// Get returns the key trusted for id, nil if there is none
+func (s *Store) Get(id appimage.AppImageID) *Key {
+	return s.Keys[id]
+}
+
+// Forget removes the key trusted for id. Returns false if there was none.
+func (s *Store) Forget(id appimage.AppImageID) bool {
+	if _, ok := s.Keys[id]; !ok {
+		return false
+	}
+	delete(s.Keys, id)
+	return true
+}
+
+// Pin trusts key for id, replacing any key trusted before
+func (s *Store) Pin(id appimage.AppImageID, key *Key) {
+	k := *key
+	k.Pinned = true
+	s.Keys[id] = &k
+}
+
+// List returns all entries, sorted by ID
+func (s *Store) List() []Entry {
+	var l []Entry
+	for id, k := range s.Keys {
+		l = append(l, Entry{ID: id, Key: k})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	return l
+}
@@ -2,6 +2,7 @@ package update
 
 import (
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,6 +14,9 @@ import (
 	"github.com/lawl/ayy/appimage"
 	"github.com/lawl/ayy/bytesz"
 	"github.com/lawl/ayy/integrate"
+	"github.com/lawl/ayy/policy"
+	"github.com/lawl/ayy/sigstore"
+	"github.com/lawl/ayy/trust"
 )
 
 type Progress struct {
@@ -20,6 +24,8 @@ type Progress struct {
 	AppName string
 	Text    string
 	Err     error
+	// something the user should know about once all is done
+	Notice string
 }
 
 func Info(aiPath string) (Updater, error) {
@@ -29,7 +35,7 @@ func Info(aiPath string) (Updater, error) {
 	}
 	defer ai.Close()
 
-	updInfo, err := ai.ELFSectionAsString(".upd_info")
+	updInfo, err := ai.UpdateInfo()
 	if err != nil {
 		return nil, err
 	}
@@ -38,7 +44,9 @@ func Info(aiPath string) (Updater, error) {
 	return updater, nil
 }
 
-func AppImage(aiPath string, ch chan Progress) {
+// AppImage updates the AppImage at aiPath, reporting progress on ch.
+// opts are passed on to integrate.Upgrade()
+func AppImage(aiPath string, opts integrate.Options, ch chan Progress) {
 	defer close(ch)
 
 	ai, err := appimage.Open(aiPath)
@@ -50,7 +58,7 @@ func AppImage(aiPath string, ch chan Progress) {
 
 	appName := ai.DesktopEntry("Name")
 
-	updInfo, err := ai.ELFSectionAsString(".upd_info")
+	updInfo, err := ai.UpdateInfo()
 	if err != nil {
 		ch <- Progress{Err: err, AppName: appName}
 		return
@@ -66,6 +74,18 @@ func AppImage(aiPath string, ch chan Progress) {
 	}
 
 	if updavail {
+		pol, err := policy.Load()
+		if err != nil {
+			ch <- Progress{Err: err, AppName: appName}
+			return
+		}
+		// the download may come from elsewhere than the update information says
+		if u, err := url.Parse(at); err == nil {
+			if err := pol.CheckUpdateHost(u.Hostname()); err != nil {
+				ch <- Progress{Err: err, AppName: appName}
+				return
+			}
+		}
 		ch <- Progress{Percent: 0, AppName: appName, Text: "Update Available", Err: nil}
 		dlch := make(chan downloadProgress)
 		targetPath := aiPath + ".ayydownload"
@@ -92,8 +112,21 @@ func AppImage(aiPath string, ch chan Progress) {
 			ch <- Progress{Err: fmt.Errorf("Installed image and downloaded update don't have matching IDs. Aborting for security reasons. Leaving downloaded file for inspection."), AppName: appName}
 			return
 		}
+		// vendors may publish a key rotation proof, a minisign signature or a Sigstore bundle next to the update
+		for _, suffix := range []string{trust.RotationSuffix, trust.MinisigSuffix, sigstore.BundleSuffix} {
+			sidecarPath := targetPath + suffix
+			defer os.Remove(sidecarPath)
+			if err := downloadOptional(at+suffix, sidecarPath); err != nil {
+				ch <- Progress{Err: fmt.Errorf("downloading %s: %w", path.Base(at+suffix), err), AppName: appName}
+				return
+			}
+		}
+		opts.KeyRotated = func(id appimage.AppImageID, r trust.Rotation) {
+			ch <- Progress{Percent: 100, AppName: appName, Text: "Installing...", Notice: r.String()}
+		}
+
 		ch <- Progress{Percent: 100, AppName: appName, Text: "Installing...", Err: nil}
-		_, err := integrate.Upgrade(targetPath, aiPath)
+		_, err = integrate.Upgrade(targetPath, aiPath, opts)
 		if err != nil {
 			ch <- Progress{Err: err, AppName: appName}
 			return
@@ -127,6 +160,22 @@ func (n plingUpdater) Check() (url string, available bool, err error) { return "
 func (n plingUpdater) InfoString() string                             { return "pling not supported" }
 
 func updaterFromUpdInfo(updInfo string, localPath string) Updater {
+	updater, err := parseUpdInfo(updInfo, localPath)
+	if err != nil && updater == nil {
+		return nullUpdater{}
+	}
+	// pling comes back with an error too, but a more helpful InfoString()
+	return updater
+}
+
+// ValidateUpdateInfo checks that updInfo is something ayy can update from,
+// i.e. that updaterFromUpdInfo wouldn't fall back to "no update information"
+func ValidateUpdateInfo(updInfo string) error {
+	_, err := parseUpdInfo(updInfo, "")
+	return err
+}
+
+func parseUpdInfo(updInfo string, localPath string) (Updater, error) {
 	updInfo = strings.TrimSpace(updInfo)
 	spl := strings.Split(updInfo, "|")
 	for i := 0; i < len(spl); i++ {
@@ -135,25 +184,30 @@ func updaterFromUpdInfo(updInfo string, localPath string) Updater {
 	switch spl[0] {
 	case "zsync":
 		if len(spl) < 2 {
-			return nullUpdater{}
+			return nil, errors.New("zsync update information needs an URL: zsync|https://example.com/Foo.AppImage.zsync")
 		}
 		purl, err := url.Parse(spl[1])
 		if err != nil {
-			return nullUpdater{}
+			return nil, fmt.Errorf("invalid zsync URL: %w", err)
 		}
 		//reject everything other than http for security reasons
 		//e.g. no http, which would be allowed by spec
 		//the spec only sais an URL...
 		if strings.ToLower(purl.Scheme) != "https" {
-			return nullUpdater{}
+			return nil, errors.New("zsync URL must be https")
 		}
 		return httpsUpdater{
 			remoteZsync: spl[1],
 			localPath:   localPath,
-		}
+		}, nil
 	case "gh-releases-zsync":
 		if len(spl) < 5 {
-			return nullUpdater{}
+			return nil, errors.New("gh-releases-zsync update information needs 4 fields: gh-releases-zsync|user|repo|release|Foo-*.AppImage.zsync")
+		}
+		for _, field := range spl[1:5] {
+			if field == "" {
+				return nil, errors.New("gh-releases-zsync update information has empty fields")
+			}
 		}
 		return ghUpdater{
 			ghUsername:  spl[1],
@@ -161,14 +215,14 @@ func updaterFromUpdInfo(updInfo string, localPath string) Updater {
 			releaseName: spl[3],
 			filename:    spl[4],
 			localPath:   localPath,
-		}
+		}, nil
 	case "pling-v1-zsync":
 		//no easy to find api docs, and they should just use regular https
 		//this should have never made the spec, refusing to implement
 		//also cannot find a single image on pling using this, so...
-		return plingUpdater{}
+		return plingUpdater{}, errors.New("pling-v1-zsync is not supported")
 	default:
-		return nullUpdater{}
+		return nil, fmt.Errorf("unknown update information type '%s', expected zsync or gh-releases-zsync", spl[0])
 	}
 }
 
@@ -220,6 +274,23 @@ func downloadFileWithProgress(url string, progressCh chan downloadProgress, targ
 	progressCh <- downloadProgress{progress: 100, err: nil, bytesDownloaded: int(bytesWrittenCounter), size: int(resp.ContentLength)}
 }
 
+// downloadOptional downloads url to targetPath, if it exists. Small files only.
+func downloadOptional(url, targetPath string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(targetPath, buf, 0644)
+}
+
 type writeProgressReporter struct {
 	ch      chan downloadProgress
 	max     int64